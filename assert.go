@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// assertSpec is the YAML file of expectations, like:
+//
+//	servers: [8.8.8.8, tls://1.1.1.1]
+//	checks:
+//	  - name: www.example.com
+//	    type: A
+//	    rrset: [192.0.2.10, 192.0.2.11]
+//	    min_ttl: 300
+//	  - name: gone.example.com
+//	    rcode: NXDOMAIN
+//	    servers: [ns1.example.com]
+type assertSpec struct {
+	Servers []string      `yaml:"servers"`
+	Checks  []assertCheck `yaml:"checks"`
+}
+
+type assertCheck struct {
+	Name    string    `yaml:"name"`
+	Type    string    `yaml:"type"`
+	RRset   *[]string `yaml:"rrset"`
+	Rcode   string    `yaml:"rcode"`
+	MinTTL  *uint32   `yaml:"min_ttl"`
+	DNSSEC  string    `yaml:"dnssec"`
+	Servers []string  `yaml:"servers"`
+
+	qtype uint16
+	rcode uint16
+}
+
+type assertResult struct {
+	check    *assertCheck
+	server   string
+	failures []string
+}
+
+func assertMain(args []string) error {
+	flags := flag.NewFlagSet("assert", flag.ExitOnError)
+	transport := flags.String("transport", TransportUDP, "transport for servers without a scheme: udp, tcp, tls or https")
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to wait for each response")
+	workers := flags.Int("c", 10, "number of checks to run at once")
+	verbose := flags.Bool("v", false, "list passing checks too")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dunce assert [flags] spec.yaml")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *workers < 1 {
+		return errors.New("need at least one worker")
+	}
+	spec, err := readAssertSpec(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var results []*assertResult
+	for i := range spec.Checks {
+		check := &spec.Checks[i]
+		servers := check.Servers
+		if len(servers) == 0 {
+			servers = spec.Servers
+		}
+		for _, server := range servers {
+			results = append(results, &assertResult{check: check, server: server})
+		}
+	}
+
+	work := make(chan *assertResult)
+	var wg sync.WaitGroup
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for result := range work {
+				result.run(*transport, *timeout)
+			}
+		}()
+	}
+	for _, result := range results {
+		work <- result
+	}
+	close(work)
+	wg.Wait()
+
+	failed := 0
+	for _, result := range results {
+		label := fmt.Sprintf("%s %s @%s", result.check.Name, typeString(result.check.qtype), strings.TrimPrefix(result.server, "@"))
+		if len(result.failures) == 0 {
+			if *verbose {
+				fmt.Printf("PASS  %s\n", label)
+			}
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL  %s\n", label)
+		for _, failure := range result.failures {
+			fmt.Printf("      %s\n", failure)
+		}
+	}
+	fmt.Printf("%d checks, %d passed, %d failed\n", len(results), len(results)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+func readAssertSpec(path string) (*assertSpec, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read spec: %w", err)
+	}
+	spec := &assertSpec{}
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	// a misspelt key would otherwise quietly drop its expectation, and the
+	// check would pass without testing it
+	dec.KnownFields(true)
+	if err := dec.Decode(spec); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unable to parse spec: %w", err)
+	}
+	if len(spec.Checks) == 0 {
+		return nil, fmt.Errorf("no checks in %s", path)
+	}
+	if len(spec.Servers) == 0 {
+		spec.Servers = []string{"8.8.8.8"}
+	}
+
+	for i := range spec.Checks {
+		check := &spec.Checks[i]
+		if check.Name == "" {
+			return nil, fmt.Errorf("check %d has no name", i+1)
+		}
+		if check.Type == "" {
+			check.Type = "A"
+		}
+		if check.qtype, err = parseType(check.Type); err != nil {
+			return nil, fmt.Errorf("check %d: %w", i+1, err)
+		}
+		if check.Rcode == "" {
+			check.Rcode = "NOERROR"
+		}
+		if check.rcode, err = parseRcode(check.Rcode); err != nil {
+			return nil, fmt.Errorf("check %d: %w", i+1, err)
+		}
+		switch check.DNSSEC {
+		case "", "secure", "insecure":
+		default:
+			return nil, fmt.Errorf("check %d: dnssec must be secure or insecure, not '%s'", i+1, check.DNSSEC)
+		}
+	}
+	return spec, nil
+}
+
+func (r *assertResult) run(transport string, timeout time.Duration) {
+	check := r.check
+	client, err := newClientForSpec(r.server, transport, timeout)
+	if err != nil {
+		r.failures = append(r.failures, err.Error())
+		return
+	}
+	defer client.Close()
+	if check.DNSSEC != "" {
+		// the AD bit is only meaningful when we've asked for DNSSEC
+		client.Options = QueryOptions{EDNS: true, DNSSECOK: true}
+	}
+
+	msg, err := client.Query(check.Name, check.qtype)
+	if err != nil {
+		r.failures = append(r.failures, err.Error())
+		return
+	}
+
+	if rcode := msg.Rcode(); rcode != check.rcode {
+		r.failures = append(r.failures, fmt.Sprintf("expected rcode %s, got %s", rcodeString(check.rcode), rcodeString(rcode)))
+	}
+
+	var answers []*DNSResourceRecord
+	for i := range msg.Answers {
+		if msg.Answers[i].TYPE == check.qtype {
+			answers = append(answers, &msg.Answers[i])
+		}
+	}
+
+	if check.RRset != nil {
+		if missing, extra := diffRRset(*check.RRset, answers); len(missing) > 0 || len(extra) > 0 {
+			var got []string
+			for _, rr := range answers {
+				got = append(got, rr.Data)
+			}
+			sort.Strings(got)
+			r.failures = append(r.failures, fmt.Sprintf("expected rrset [%s], got [%s]",
+				strings.Join(*check.RRset, ", "), strings.Join(got, ", ")))
+		}
+	}
+
+	if check.MinTTL != nil {
+		for _, rr := range answers {
+			if rr.TTL < *check.MinTTL {
+				r.failures = append(r.failures, fmt.Sprintf("expected ttl of at least %d, got %d for %s", *check.MinTTL, rr.TTL, rr.Data))
+			}
+		}
+	}
+
+	switch {
+	case check.DNSSEC == "secure" && msg.Header.AD != 1:
+		r.failures = append(r.failures, "expected a secure answer, but the AD flag is not set")
+	case check.DNSSEC == "insecure" && msg.Header.AD == 1:
+		r.failures = append(r.failures, "expected an insecure answer, but the AD flag is set")
+	}
+}
+
+// diffRRset matches the expected values against the answers, ignoring order,
+// and returns the values that weren't answered and the answers that weren't
+// expected.
+func diffRRset(expected []string, answers []*DNSResourceRecord) ([]string, []*DNSResourceRecord) {
+	matched := make([]bool, len(answers))
+	var missing []string
+	for _, value := range expected {
+		found := false
+		for i, rr := range answers {
+			if !matched[i] && rdataMatches(rr, value) {
+				matched[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, value)
+		}
+	}
+	var extra []*DNSResourceRecord
+	for i, rr := range answers {
+		if !matched[i] {
+			extra = append(extra, rr)
+		}
+	}
+	return missing, extra
+}
+
+// rdataMatches compares a hand written value with a record's data, allowing
+// for the differences people don't care about: case and trailing dots on
+// names, and quotes on TXT records.
+func rdataMatches(rr *DNSResourceRecord, value string) bool {
+	if rr.Data == value {
+		return true
+	}
+	switch rr.TYPE {
+	case TypeTXT:
+		var text strings.Builder
+		for p := 0; p < len(rr.RDATA); {
+			l := int(rr.RDATA[p])
+			if p+1+l > len(rr.RDATA) {
+				return false
+			}
+			text.Write(rr.RDATA[p+1 : p+1+l])
+			p += 1 + l
+		}
+		return text.String() == value
+	case TypeNS, TypeCNAME, TypePTR, TypeDNAME, TypeMX, TypeSRV, TypeSOA:
+		got, want := strings.Fields(rr.Data), strings.Fields(value)
+		if len(got) != len(want) {
+			return false
+		}
+		for i := range got {
+			if !strings.EqualFold(strings.TrimSuffix(got[i], "."), strings.TrimSuffix(want[i], ".")) {
+				return false
+			}
+		}
+		return true
+	case TypeAAAA:
+		// IPv6 addresses have more than one way to write them
+		got, want := net.ParseIP(rr.Data), net.ParseIP(value)
+		return got != nil && got.Equal(want)
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadAssertSpec(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		err  string // a part of the error, empty for none
+	}{
+		{"good", "checks:\n  - name: www.example.com\n    rrset: [192.0.2.1]\n    min_ttl: 300\n", ""},
+		{"empty", "", "no checks"},
+		{"misspelt check key", "checks:\n  - name: www.example.com\n    min-ttl: 300\n", "min-ttl"},
+		{"misspelt top level key", "server: [192.0.2.53]\nchecks:\n  - name: www.example.com\n", "server"},
+		{"bad type", "checks:\n  - name: www.example.com\n    type: BOGUS\n", "BOGUS"},
+		{"bad dnssec", "checks:\n  - name: www.example.com\n    dnssec: yes\n", "dnssec"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "spec.yaml")
+		if err := os.WriteFile(path, []byte(tt.spec), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readAssertSpec(path)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got %v, want an error about %s", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestRdataMatches(t *testing.T) {
+	tests := []struct {
+		rr    DNSResourceRecord
+		value string
+		want  bool
+	}{
+		{testRR(t, "www.example.", TypeA, "192.0.2.1"), "192.0.2.1", true},
+		{testRR(t, "www.example.", TypeA, "192.0.2.1"), "192.0.2.2", false},
+		{testRR(t, "www.example.", TypeAAAA, "2001:db8::1"), "2001:db8::1", true},
+		{testRR(t, "www.example.", TypeAAAA, "2001:db8::1"), "2001:0DB8:0:0:0:0:0:1", true},
+		{testRR(t, "www.example.", TypeAAAA, "2001:db8::1"), "2001:db8::2", false},
+		{testRR(t, "www.example.", TypeAAAA, "2001:db8::1"), "not an address", false},
+		{testRR(t, "example.", TypeNS, "ns1.example."), "ns1.example.", true},
+		{testRR(t, "example.", TypeNS, "ns1.example."), "NS1.Example", true},
+		{testRR(t, "example.", TypeNS, "ns1.example."), "ns2.example.", false},
+		{testRR(t, "www.example.", TypeCNAME, "web.example."), "WEB.example", true},
+		{testRR(t, "example.", TypeMX, "10 mx.example."), "10 MX.example", true},
+		{testRR(t, "example.", TypeMX, "10 mx.example."), "20 mx.example.", false},
+		{testRR(t, "example.", TypeMX, "10 mx.example."), "mx.example.", false},
+		{testRR(t, "example.", TypeTXT, "v=spf1"), `"v=spf1"`, true},
+		{testRR(t, "example.", TypeTXT, "v=spf1"), "v=spf1", true},
+		{testRR(t, "example.", TypeTXT, "v=spf1"), "V=SPF1", false},
+		{testRR(t, "example.", TypeTXT, "split across strings"), "splitacrossstrings", true},
+		// only names get their case ignored
+		{testRR(t, "example.", TypeTXT, "Hello"), "hello", false},
+	}
+	for _, tt := range tests {
+		if got := rdataMatches(&tt.rr, tt.value); got != tt.want {
+			t.Errorf("%s %s %s matching %q: got %v", tt.rr.NAME, typeString(tt.rr.TYPE), tt.rr.Data, tt.value, got)
+		}
+	}
+}
+
+func TestDiffRRset(t *testing.T) {
+	a := testRR(t, "www.example.", TypeA, "192.0.2.1")
+	b := testRR(t, "www.example.", TypeA, "192.0.2.2")
+	tests := []struct {
+		name     string
+		expected []string
+		answers  []*DNSResourceRecord
+		missing  []string
+		extra    []string
+	}{
+		{"same", []string{"192.0.2.1", "192.0.2.2"}, []*DNSResourceRecord{&a, &b}, nil, nil},
+		{"any order", []string{"192.0.2.2", "192.0.2.1"}, []*DNSResourceRecord{&a, &b}, nil, nil},
+		{"missing", []string{"192.0.2.1", "192.0.2.3"}, []*DNSResourceRecord{&a}, []string{"192.0.2.3"}, nil},
+		{"extra", []string{"192.0.2.1"}, []*DNSResourceRecord{&a, &b}, nil, []string{"192.0.2.2"}},
+		{"expected twice", []string{"192.0.2.1", "192.0.2.1"}, []*DNSResourceRecord{&a}, []string{"192.0.2.1"}, nil},
+		{"expected empty", []string{}, []*DNSResourceRecord{&a}, nil, []string{"192.0.2.1"}},
+		{"nothing", nil, nil, nil, nil},
+	}
+	for _, tt := range tests {
+		missing, extra := diffRRset(tt.expected, tt.answers)
+		var extraData []string
+		for _, rr := range extra {
+			extraData = append(extraData, rr.Data)
+		}
+		if strings.Join(missing, " ") != strings.Join(tt.missing, " ") || strings.Join(extraData, " ") != strings.Join(tt.extra, " ") {
+			t.Errorf("%s: got missing %v and extra %v", tt.name, missing, extraData)
+		}
+	}
+}
+
+// assertServers serves example. on one server that sets AD on answers to
+// DNSSEC queries and on another that never does, and returns the two.
+func assertServers(t *testing.T) (secure, insecure string) {
+	zone := &fakeZone{name: "example.", records: []DNSResourceRecord{
+		testRR(t, "example.", TypeSOA, "ns.example. hostmaster.example. 1 3600 600 86400 60"),
+		testRR(t, "www.example.", TypeA, "192.0.2.1"),
+		testRR(t, "www.example.", TypeA, "192.0.2.2"),
+		testRR(t, "www.example.", TypeAAAA, "2001:db8::1"),
+		testRR(t, "example.", TypeTXT, "v=spf1"),
+	}}
+	secure = serveFake(t, "127.0.0.1:0", func(query *DNSMessage) *DNSMessage {
+		resp := zone.answer(query)
+		if opt := query.OPT(); opt != nil && opt.TTL&(1<<15) != 0 {
+			resp.Header.AD = 1
+		}
+		return resp
+	})
+	return secure, serveFake(t, "127.0.0.1:0", zone.answer)
+}
+
+func TestAssertResultRun(t *testing.T) {
+	secure, insecure := assertServers(t)
+	tests := []struct {
+		name     string
+		check    string
+		server   string
+		failures []string // the start of each failure
+	}{
+		{"rrset", "name: www.example.\nrrset: [192.0.2.2, 192.0.2.1]", insecure, nil},
+		{"wrong rrset", "name: www.example.\nrrset: [192.0.2.1]", insecure,
+			[]string{"expected rrset [192.0.2.1], got [192.0.2.1, 192.0.2.2]"}},
+		{"empty rrset", "name: www.example.\ntype: MX\nrrset: []", insecure, nil},
+		{"aaaa", "name: www.example.\ntype: AAAA\nrrset: ['2001:DB8:0::1']", insecure, nil},
+		{"txt", "name: EXAMPLE\ntype: TXT\nrrset: [v=spf1]", insecure, nil},
+		{"nxdomain", "name: gone.example.\nrcode: NXDOMAIN", insecure, nil},
+		{"wrong rcode", "name: gone.example.", insecure, []string{"expected rcode NOERROR, got NXDOMAIN"}},
+		{"min ttl", "name: www.example.\nmin_ttl: 3600", insecure, nil},
+		{"short ttl", "name: www.example.\nmin_ttl: 7200", insecure,
+			[]string{"expected ttl of at least 7200, got 3600 for 192.0.2.1", "expected ttl of at least 7200, got 3600 for 192.0.2.2"}},
+		{"secure", "name: www.example.\ndnssec: secure", secure, nil},
+		{"not secure", "name: www.example.\ndnssec: secure", insecure, []string{"expected a secure answer"}},
+		{"insecure", "name: www.example.\ndnssec: insecure", insecure, nil},
+		{"not insecure", "name: www.example.\ndnssec: insecure", secure, []string{"expected an insecure answer"}},
+	}
+	for _, tt := range tests {
+		spec := writeAssertSpec(t, "checks:\n  - "+strings.ReplaceAll(tt.check, "\n", "\n    ")+"\n")
+		result := &assertResult{check: &spec.Checks[0], server: tt.server}
+		result.run(TransportUDP, time.Second)
+		if len(result.failures) != len(tt.failures) {
+			t.Errorf("%s: got failures %q", tt.name, result.failures)
+			continue
+		}
+		for i, failure := range result.failures {
+			if !strings.HasPrefix(failure, tt.failures[i]) {
+				t.Errorf("%s: got %q, want %q", tt.name, failure, tt.failures[i])
+			}
+		}
+	}
+}
+
+func TestAssertMain(t *testing.T) {
+	secure, insecure := assertServers(t)
+	tests := []struct {
+		name    string
+		spec    string
+		failed  bool
+		summary string
+	}{
+		{"pass", "servers: [" + secure + ", " + insecure + "]\nchecks:\n  - name: www.example.\n    rrset: [192.0.2.1, 192.0.2.2]\n",
+			false, "2 checks, 2 passed, 0 failed"},
+		{"fail", "checks:\n  - name: www.example.\n    dnssec: secure\n    servers: [" + secure + ", " + insecure + "]\n",
+			true, "2 checks, 1 passed, 1 failed"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "spec.yaml")
+		if err := os.WriteFile(path, []byte(tt.spec), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		out := captureStdout(t, func() {
+			err = assertMain([]string{"-timeout", "1s", path})
+		})
+		if (err != nil) != tt.failed || !strings.Contains(out, tt.summary) {
+			t.Errorf("%s: got %v and:\n%s", tt.name, err, out)
+		}
+		if tt.failed && !strings.Contains(out, "FAIL  www.example. A @"+insecure) {
+			t.Errorf("%s: the failing server isn't named in:\n%s", tt.name, out)
+		}
+	}
+}
+
+func writeAssertSpec(t *testing.T, spec string) *assertSpec {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "spec.yaml")
+	if err := os.WriteFile(path, []byte(spec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := readAssertSpec(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
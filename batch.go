@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type batchQuery struct {
+	line   int
+	name   string // empty for blank lines and comments
+	qtype  uint16
+	typ    string // as written, in case it doesn't parse
+	server string
+	err    error
+}
+
+type batchResult struct {
+	Line      int      `json:"line"`
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Server    string   `json:"server"`
+	Rcode     string   `json:"rcode,omitempty"`
+	Flags     string   `json:"flags,omitempty"`
+	LatencyMS float64  `json:"latency_ms"`
+	Answers   []string `json:"answers"`
+	EDE       []string `json:"extended_errors,omitempty"`
+	NSID      string   `json:"nsid,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type batchWriter interface {
+	Write(result *batchResult) error
+	Flush() error
+}
+
+func batchMain(args []string) error {
+	flags := flag.NewFlagSet("batch", flag.ExitOnError)
+	queriesFile := flags.String("f", "-", "file of queries, one 'name type [@server]' per line, or - for stdin")
+	server := flags.String("server", "8.8.8.8", "server for queries that don't name one")
+	transport := flags.String("transport", TransportUDP, "transport for servers without a scheme: udp, tcp, tls or https")
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to wait for each response")
+	workers := flags.Int("c", 20, "number of queries to run at once")
+	format := flags.String("format", "text", "output format: text, json or csv")
+	nsid := flags.Bool("nsid", false, "ask each server to identify itself with NSID (RFC 5001)")
+	flags.Parse(args)
+
+	if *workers < 1 {
+		return errors.New("need at least one worker")
+	}
+	var out batchWriter
+	switch *format {
+	case "text":
+		out = &textBatchWriter{w: os.Stdout}
+	case "json":
+		out = &jsonBatchWriter{encoder: json.NewEncoder(os.Stdout)}
+	case "csv":
+		out = &csvBatchWriter{w: csv.NewWriter(os.Stdout)}
+	default:
+		return fmt.Errorf("unknown format '%s'", *format)
+	}
+
+	in := os.Stdin
+	if *queriesFile != "-" {
+		f, err := os.Open(*queriesFile)
+		if err != nil {
+			return fmt.Errorf("unable to open queries file: %w", err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	queries := make(chan batchQuery)
+	results := make(chan *batchResult)
+	var wg sync.WaitGroup
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batchWorker(queries, results, *transport, *timeout, *nsid)
+		}()
+	}
+
+	var readErr error
+	go func() {
+		readErr = readBatchQueries(in, *server, queries)
+		close(queries)
+		wg.Wait()
+		close(results)
+	}()
+
+	// results come back in whatever order they finish, but get written in
+	// the order of the input
+	pending := make(map[int]*batchResult)
+	next, failed, total := 1, 0, 0
+	var writeErr error
+	for result := range results {
+		pending[result.Line] = result
+		for {
+			r, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if r.Name == "" {
+				continue
+			}
+			total++
+			if r.Error != "" {
+				failed++
+			}
+			if err := out.Write(r); err != nil && writeErr == nil {
+				writeErr = err
+			}
+		}
+	}
+	if err := out.Flush(); err != nil && writeErr == nil {
+		writeErr = err
+	}
+
+	if readErr != nil {
+		return readErr
+	}
+	if writeErr != nil {
+		return fmt.Errorf("unable to write results: %w", writeErr)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d queries failed", failed, total)
+	}
+	return nil
+}
+
+// readBatchQueries sends every line of input to the workers, including blank
+// lines and comments, so that every line number gets a result.
+func readBatchQueries(in io.Reader, server string, queries chan<- batchQuery) error {
+	scanner := bufio.NewScanner(in)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		query := batchQuery{line: line, server: server, qtype: TypeA}
+		switch {
+		case len(fields) == 0 || strings.HasPrefix(fields[0], "#"):
+		case len(fields) > 3:
+			query.name = fields[0]
+			query.err = fmt.Errorf("expected 'name type [@server]', got %d fields", len(fields))
+		default:
+			query.name = fields[0]
+			if len(fields) > 1 {
+				query.typ = fields[1]
+				query.qtype, query.err = parseType(fields[1])
+			}
+			if len(fields) > 2 {
+				query.server = strings.TrimPrefix(fields[2], "@")
+			}
+		}
+		queries <- query
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read queries: %w", err)
+	}
+	return nil
+}
+
+func batchWorker(queries <-chan batchQuery, results chan<- *batchResult, transport string, timeout time.Duration, nsid bool) {
+	// each worker keeps its own connections, one per server it has seen
+	clients := make(map[string]*Client)
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+
+	for query := range queries {
+		result := &batchResult{
+			Line:    query.line,
+			Name:    query.name,
+			Type:    typeString(query.qtype),
+			Server:  query.server,
+			Answers: []string{},
+		}
+		if query.name == "" {
+			results <- result
+			continue
+		}
+		if query.err != nil {
+			if query.typ != "" {
+				result.Type = query.typ
+			}
+			result.Error = query.err.Error()
+			results <- result
+			continue
+		}
+
+		client, ok := clients[query.server]
+		if !ok {
+			var err error
+			if client, err = newClientForSpec(query.server, transport, timeout); err != nil {
+				result.Error = err.Error()
+				results <- result
+				continue
+			}
+			// EDNS, so servers can tell us why with an Extended DNS Error
+			client.Options.EDNS = true
+			client.Options.EDNSFallback = true
+			client.Options.NSID = nsid
+			clients[query.server] = client
+		}
+
+		start := time.Now()
+		msg, err := client.Query(query.name, query.qtype)
+		result.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Rcode = rcodeString(msg.Rcode())
+			result.Flags = msg.Header.Flags()
+			for i := range msg.Answers {
+				result.Answers = append(result.Answers, msg.Answers[i].String())
+			}
+			for _, e := range msg.ExtendedErrors() {
+				result.EDE = append(result.EDE, e.String())
+			}
+			if id, ok := msg.NSID(); ok {
+				result.NSID = nsidString(id)
+			}
+		}
+		results <- result
+	}
+}
+
+type textBatchWriter struct {
+	w io.Writer
+}
+
+func (t *textBatchWriter) Write(r *batchResult) error {
+	if r.Error != "" {
+		_, err := fmt.Fprintf(t.w, "%s %s %s error: %s\n", r.Name, r.Type, r.Server, r.Error)
+		return err
+	}
+	if _, err := fmt.Fprintf(t.w, "%s %s %s %s %.3fms\n", r.Name, r.Type, r.Server, r.Rcode, r.LatencyMS); err != nil {
+		return err
+	}
+	if r.NSID != "" {
+		if _, err := fmt.Fprintf(t.w, "  NSID: %s\n", r.NSID); err != nil {
+			return err
+		}
+	}
+	for _, e := range r.EDE {
+		if _, err := fmt.Fprintf(t.w, "  EDE: %s\n", e); err != nil {
+			return err
+		}
+	}
+	for _, answer := range r.Answers {
+		if _, err := fmt.Fprintf(t.w, "  %s\n", answer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *textBatchWriter) Flush() error {
+	return nil
+}
+
+type jsonBatchWriter struct {
+	encoder *json.Encoder
+}
+
+func (j *jsonBatchWriter) Write(r *batchResult) error {
+	return j.encoder.Encode(r)
+}
+
+func (j *jsonBatchWriter) Flush() error {
+	return nil
+}
+
+type csvBatchWriter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func (c *csvBatchWriter) Write(r *batchResult) error {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		c.w.Write([]string{"line", "name", "type", "server", "rcode", "flags", "latency_ms", "answers", "error", "extended_errors", "nsid"})
+	}
+	// answers are joined with newlines, which csv quotes properly
+	return c.w.Write([]string{
+		strconv.Itoa(r.Line),
+		r.Name,
+		r.Type,
+		r.Server,
+		r.Rcode,
+		r.Flags,
+		strconv.FormatFloat(r.LatencyMS, 'f', 3, 64),
+		strings.Join(r.Answers, "\n"),
+		r.Error,
+		strings.Join(r.EDE, "\n"),
+		r.NSID,
+	})
+}
+
+func (c *csvBatchWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
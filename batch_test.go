@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadBatchQueries(t *testing.T) {
+	input := "# a comment\nwww.example.\n\nwww.example. AAAA @192.0.2.53\n  mail.example.  MX  \nwww.example. BOGUS\none two three four\n"
+	queries := make(chan batchQuery, 10)
+	if err := readBatchQueries(strings.NewReader(input), "192.0.2.1", queries); err != nil {
+		t.Fatal(err)
+	}
+	close(queries)
+	want := []struct {
+		name   string
+		qtype  uint16
+		server string
+		err    string
+	}{
+		{"", TypeA, "192.0.2.1", ""},
+		{"www.example.", TypeA, "192.0.2.1", ""},
+		{"", TypeA, "192.0.2.1", ""},
+		{"www.example.", TypeAAAA, "192.0.2.53", ""},
+		{"mail.example.", TypeMX, "192.0.2.1", ""},
+		{"www.example.", 0, "192.0.2.1", "BOGUS"},
+		{"one", TypeA, "192.0.2.1", "expected 'name type [@server]', got 4 fields"},
+	}
+	line := 0
+	for query := range queries {
+		if line >= len(want) {
+			t.Fatalf("got an extra query %+v", query)
+		}
+		w := want[line]
+		line++
+		if query.line != line || query.name != w.name || query.server != w.server {
+			t.Errorf("line %d: got %+v", line, query)
+		}
+		if w.err == "" && (query.err != nil || query.qtype != w.qtype) {
+			t.Errorf("line %d: got type %d and %v", line, query.qtype, query.err)
+		}
+		if w.err != "" && (query.err == nil || !strings.Contains(query.err.Error(), w.err)) {
+			t.Errorf("line %d: got %v, want an error about %s", line, query.err, w.err)
+		}
+	}
+	if line != len(want) {
+		t.Errorf("got %d queries, want %d", line, len(want))
+	}
+}
+
+// runBatch runs batch on the input with the flags, and returns what it
+// printed and the error it returned.
+func runBatch(t *testing.T, input string, flags ...string) (string, error) {
+	path := filepath.Join(t.TempDir(), "queries.txt")
+	if err := os.WriteFile(path, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	out := captureStdout(t, func() {
+		err = batchMain(append(flags, "-f", path, "-timeout", "1s"))
+	})
+	return out, err
+}
+
+// batchServers serves example. on three servers: the default, one that takes
+// its time, and another with a different address for www.
+func batchServers(t *testing.T) (fast, slow, other string) {
+	zone := testZone(t)
+	fast = serveFake(t, "127.0.0.1:0", zone.answer)
+	slow = serveFake(t, "127.0.0.1:0", func(query *DNSMessage) *DNSMessage {
+		time.Sleep(100 * time.Millisecond)
+		return zone.answer(query)
+	})
+	other = serveFake(t, "127.0.0.1:0", (&fakeZone{name: "example.", records: []DNSResourceRecord{
+		testRR(t, "www.example.", TypeA, "198.51.100.1"),
+	}}).answer)
+	return fast, slow, other
+}
+
+func TestBatchJSON(t *testing.T) {
+	fast, slow, other := batchServers(t)
+	// the slow first query finishes last, but still gets written first
+	input := "# header comment\nwww.example. A @" + slow + "\n\nwww.example. AAAA\nwww.example. A @" + other +
+		"\nmissing.example.\nwww.example. A extra fields\n"
+	out, err := runBatch(t, input, "-format", "json", "-server", fast, "-c", "4")
+	if err == nil || err.Error() != "1 of 5 queries failed" {
+		t.Errorf("got error %v", err)
+	}
+
+	want := []batchResult{
+		{Line: 2, Name: "www.example.", Type: "A", Server: slow, Rcode: "NOERROR", Flags: "qr aa rd", Answers: []string{"www.example.\t3600\tIN\tA\t192.0.2.1"}},
+		{Line: 4, Name: "www.example.", Type: "AAAA", Server: fast, Rcode: "NOERROR", Flags: "qr aa rd", Answers: []string{}},
+		{Line: 5, Name: "www.example.", Type: "A", Server: other, Rcode: "NOERROR", Flags: "qr aa rd", Answers: []string{"www.example.\t3600\tIN\tA\t198.51.100.1"}},
+		{Line: 6, Name: "missing.example.", Type: "A", Server: fast, Rcode: "NXDOMAIN", Flags: "qr aa rd", Answers: []string{}},
+		{Line: 7, Name: "www.example.", Type: "A", Server: fast, Answers: []string{}, Error: "expected 'name type [@server]', got 4 fields"},
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got:\n%s", out)
+	}
+	for i, line := range lines {
+		var got batchResult
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Error == "" && got.LatencyMS <= 0 {
+			t.Errorf("line %d: latency is %v", got.Line, got.LatencyMS)
+		}
+		got.LatencyMS = 0
+		w := want[i]
+		if got.Line != w.Line || got.Name != w.Name || got.Type != w.Type || got.Server != w.Server ||
+			got.Rcode != w.Rcode || got.Flags != w.Flags || got.Error != w.Error ||
+			strings.Join(got.Answers, "|") != strings.Join(w.Answers, "|") {
+			t.Errorf("result %d: got %+v, want %+v", i, got, w)
+		}
+	}
+	// answers is always there, even when empty
+	if !strings.Contains(lines[1], `"answers":[]`) {
+		t.Errorf("empty answers missing from %s", lines[1])
+	}
+}
+
+func TestBatchCSV(t *testing.T) {
+	fast, _, other := batchServers(t)
+	input := "www.example.\nwww.example. A @" + other + "\n"
+	out, err := runBatch(t, input, "-format", "csv", "-server", fast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := "line,name,type,server,rcode,flags,latency_ms,answers,error,extended_errors,nsid"
+	if len(rows) != 3 || strings.Join(rows[0], ",") != header {
+		t.Fatalf("got:\n%s", out)
+	}
+	want := [][]string{
+		{"1", "www.example.", "A", fast, "NOERROR", "qr aa rd", "www.example.\t3600\tIN\tA\t192.0.2.1", "", "", ""},
+		{"2", "www.example.", "A", other, "NOERROR", "qr aa rd", "www.example.\t3600\tIN\tA\t198.51.100.1", "", "", ""},
+	}
+	for i, row := range rows[1:] {
+		if len(row) != 11 {
+			t.Errorf("row %d has %d fields", i+1, len(row))
+			continue
+		}
+		// everything but the latency
+		got := append(append([]string{}, row[:6]...), row[7:]...)
+		if strings.Join(got, ",") != strings.Join(want[i], ",") {
+			t.Errorf("row %d: got %q, want %q", i+1, got, want[i])
+		}
+	}
+}
+
+func TestBatchText(t *testing.T) {
+	fast, _, _ := batchServers(t)
+	out, err := runBatch(t, "www.example.\nmissing.example. bogus\n", "-server", fast)
+	if err == nil {
+		t.Error("no error for a failed query")
+	}
+	lines := strings.Split(out, "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "www.example. A "+fast+" NOERROR ") ||
+		lines[1] != "  www.example.\t3600\tIN\tA\t192.0.2.1" ||
+		lines[2] != "missing.example. bogus "+fast+" error: unknown record type 'BOGUS'" {
+		t.Errorf("got:\n%s", out)
+	}
+}
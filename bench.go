@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type benchQuery struct {
+	name  string
+	qtype uint16
+}
+
+type benchStats struct {
+	mu        sync.Mutex
+	sent      int
+	lost      int
+	errors    int
+	rcodes    map[uint16]int
+	latencies []time.Duration
+	lastError error
+}
+
+func (s *benchStats) record(latency time.Duration, rcode uint16, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent++
+	if err != nil {
+		if isTimeout(err) {
+			s.lost++
+		} else {
+			s.errors++
+			s.lastError = err
+		}
+		return
+	}
+	s.rcodes[rcode]++
+	s.latencies = append(s.latencies, latency)
+}
+
+func benchMain(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	server := flags.String("server", "127.0.0.1", "server to query")
+	transport := flags.String("transport", TransportUDP, "transport to use: udp, tcp, tls or https")
+	namesFile := flags.String("f", "", "file of queries, one 'name [type]' per line")
+	random := flags.String("random", "", "query random names under this domain instead of a names file")
+	typeName := flags.String("type", "A", "record type for queries that don't name one")
+	qps := flags.Int("qps", 0, "target queries per second across all workers, 0 for as fast as possible")
+	workers := flags.Int("c", 1, "number of concurrent workers")
+	duration := flags.Duration("duration", 10*time.Second, "how long to send queries for")
+	timeout := flags.Duration("timeout", 2*time.Second, "how long to wait for each response")
+	flags.Parse(args)
+
+	qtype, err := parseType(*typeName)
+	if err != nil {
+		return err
+	}
+	if *workers < 1 {
+		return errors.New("need at least one worker")
+	}
+
+	var next func() benchQuery
+	switch {
+	case *namesFile != "" && *random != "":
+		return errors.New("use either a names file or random names, not both")
+	case *namesFile != "":
+		queries, err := readBenchQueries(*namesFile, qtype)
+		if err != nil {
+			return err
+		}
+		var i atomic.Uint64
+		next = func() benchQuery {
+			return queries[(i.Add(1)-1)%uint64(len(queries))]
+		}
+	case *random != "":
+		domain := strings.TrimSuffix(*random, ".")
+		next = func() benchQuery {
+			return benchQuery{name: randomLabel() + "." + domain, qtype: qtype}
+		}
+	default:
+		return errors.New("need a names file (-f) or a domain for random names (-random)")
+	}
+
+	// the pacer hands out one token per query when there's a target rate
+	var tokens chan struct{}
+	start := time.Now()
+	end := start.Add(*duration)
+	if *qps > 0 {
+		tokens = make(chan struct{})
+		go pace(tokens, time.Second/time.Duration(*qps), end)
+	}
+
+	stats := &benchStats{rcodes: make(map[uint16]int)}
+	var wg sync.WaitGroup
+	for w := 0; w < *workers; w++ {
+		client, err := NewClient(*transport, *server, *timeout)
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer client.Close()
+			benchWorker(client, next, tokens, end, stats)
+		}()
+	}
+	wg.Wait()
+
+	printBenchStats(stats, time.Since(start))
+	return nil
+}
+
+func readBenchQueries(path string, qtype uint16) ([]benchQuery, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open names file: %w", err)
+	}
+	defer f.Close()
+
+	var queries []benchQuery
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		query := benchQuery{name: fields[0], qtype: qtype}
+		if len(fields) > 1 {
+			if query.qtype, err = parseType(fields[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+		}
+		queries = append(queries, query)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read names file: %w", err)
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("no queries in %s", path)
+	}
+	return queries, nil
+}
+
+func randomLabel() string {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		panic("unable to generate random label")
+	}
+	return hex.EncodeToString(buf)
+}
+
+func pace(tokens chan<- struct{}, interval time.Duration, end time.Time) {
+	defer close(tokens)
+	deadline := time.NewTimer(time.Until(end))
+	defer deadline.Stop()
+	next := time.Now()
+	for next.Before(end) {
+		time.Sleep(time.Until(next))
+		select {
+		case tokens <- struct{}{}:
+		case <-deadline.C:
+			return
+		}
+		// don't burst to catch up after the workers fell behind
+		next = next.Add(interval)
+		if now := time.Now(); now.Sub(next) > interval {
+			next = now
+		}
+	}
+}
+
+func benchWorker(client *Client, next func() benchQuery, tokens <-chan struct{}, end time.Time, stats *benchStats) {
+	for time.Now().Before(end) {
+		if tokens != nil {
+			if _, ok := <-tokens; !ok {
+				return
+			}
+		}
+
+		q := next()
+		query, err := newQuery(q.name, q.qtype, QueryOptions{})
+		if err != nil {
+			stats.record(0, 0, err)
+			continue
+		}
+		sent := time.Now()
+		resp, err := client.Exchange(query)
+		latency := time.Since(sent)
+		if err != nil {
+			stats.record(latency, 0, err)
+			continue
+		}
+
+		var header DNSHeader
+		if err := header.Unpack(resp); err != nil {
+			stats.record(latency, 0, err)
+		} else if header.QR != 1 {
+			stats.record(latency, 0, errors.New("response is not marked as a response"))
+		} else {
+			stats.record(latency, header.RCODE, nil)
+		}
+	}
+}
+
+func printBenchStats(stats *benchStats, elapsed time.Duration) {
+	received := len(stats.latencies)
+	fmt.Printf("queries sent:      %d\n", stats.sent)
+	fmt.Printf("responses:         %d\n", received)
+	fmt.Printf("lost:              %d (%.2f%%)\n", stats.lost, percent(stats.lost, stats.sent))
+	fmt.Printf("errors:            %d\n", stats.errors)
+	if stats.lastError != nil {
+		fmt.Printf("last error:        %v\n", stats.lastError)
+	}
+	fmt.Printf("elapsed:           %.2fs\n", elapsed.Seconds())
+	fmt.Printf("throughput:        %.1f qps\n", float64(received)/elapsed.Seconds())
+
+	if received == 0 {
+		return
+	}
+
+	fmt.Println("rcodes:")
+	rcodes := make([]uint16, 0, len(stats.rcodes))
+	for rcode := range stats.rcodes {
+		rcodes = append(rcodes, rcode)
+	}
+	sort.Slice(rcodes, func(i, j int) bool { return rcodes[i] < rcodes[j] })
+	for _, rcode := range rcodes {
+		count := stats.rcodes[rcode]
+		fmt.Printf("  %-10s %d (%.2f%%)\n", rcodeString(rcode), count, percent(count, received))
+	}
+
+	latencies := stats.latencies
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var total time.Duration
+	for _, latency := range latencies {
+		total += latency
+	}
+	fmt.Println("latency:")
+	fmt.Printf("  min        %v\n", latencies[0])
+	fmt.Printf("  mean       %v\n", total/time.Duration(received))
+	for _, p := range []float64{50, 90, 99, 99.9} {
+		fmt.Printf("  p%-9g %v\n", p, percentile(latencies, p))
+	}
+	fmt.Printf("  max        %v\n", latencies[received-1])
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// percentile uses the nearest-rank method on already sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	} else if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
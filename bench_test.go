@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	var latencies []time.Duration
+	for i := 1; i <= 7; i++ {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	tests := []struct {
+		sorted []time.Duration
+		p      float64
+		want   time.Duration
+	}{
+		{latencies, 0, time.Millisecond},
+		{latencies, 50, 4 * time.Millisecond},
+		{latencies, 90, 7 * time.Millisecond}, // rank 6.3 rounds up
+		{latencies, 99.9, 7 * time.Millisecond},
+		{latencies, 100, 7 * time.Millisecond},
+		{latencies[:1], 50, time.Millisecond},
+		{latencies[:4], 25, time.Millisecond},
+		{latencies[:4], 26, 2 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.sorted, tt.p); got != tt.want {
+			t.Errorf("p%g of %v: got %v, want %v", tt.p, tt.sorted, got, tt.want)
+		}
+	}
+}
+
+func TestPace(t *testing.T) {
+	tokens := make(chan struct{})
+	start := time.Now()
+	go pace(tokens, 20*time.Millisecond, start.Add(200*time.Millisecond))
+
+	n := 0
+	for range tokens {
+		n++
+		if n == 3 {
+			// fall well behind, which mustn't cause a burst to catch up
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("tokens channel closed after %v", elapsed)
+	}
+	// 10 at the full rate, less the ones skipped while behind
+	if n < 3 || n > 7 {
+		t.Errorf("got %d tokens in 200ms at one per 20ms, having fallen 100ms behind", n)
+	}
+}
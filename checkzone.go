@@ -0,0 +1,404 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// serverCheck holds what one address of one of the zone's nameservers told
+// us.
+type serverCheck struct {
+	name string
+	addr string
+
+	err       error // from the udp SOA query, nothing else is checked if set
+	rcode     uint16
+	aa        bool
+	hasSerial bool
+	serial    uint32
+	ns        []string
+	nsErr     error
+	tcpErr    error
+	ednsErr   error
+}
+
+func (s *serverCheck) String() string {
+	return fmt.Sprintf("%s (%s)", s.name, s.addr)
+}
+
+func checkZoneMain(args []string) error {
+	flags := flag.NewFlagSet("check-zone", flag.ExitOnError)
+	server := flags.String("server", "8.8.8.8", "recursive resolver for finding the parent zone and nameserver addresses")
+	port := flags.String("port", "53", "port to query the zone's nameservers on")
+	timeout := flags.Duration("timeout", 3*time.Second, "how long to wait for each response")
+	only4 := flags.Bool("4", false, "only check nameservers over IPv4")
+	only6 := flags.Bool("6", false, "only check nameservers over IPv6")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dunce check-zone [flags] zone")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *only4 && *only6 {
+		return errors.New("use either -4 or -6, not both")
+	}
+	want4, want6 := !*only6, !*only4
+	zone := canonicalName(flags.Arg(0))
+	if zone == "." {
+		return errors.New("the root zone has no parent to check against")
+	}
+
+	resolver, err := newClientForSpec(*server, TransportUDP, *timeout)
+	if err != nil {
+		return err
+	}
+	defer resolver.Close()
+
+	parent, parentServers, err := findParent(resolver, zone)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("zone:    %s\n", zone)
+	fmt.Printf("parent:  %s (%s)\n", parent, strings.Join(parentServers, " "))
+
+	delegation, glue, from, err := findDelegation(resolver, zone, parentServers, *port, *timeout, want4, want6)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\ndelegation from %s:\n", from)
+	for _, ns := range delegation {
+		if len(glue[ns]) > 0 {
+			fmt.Printf("  %s  glue %s\n", ns, strings.Join(glue[ns], " "))
+		} else {
+			fmt.Printf("  %s\n", ns)
+		}
+	}
+
+	var problems []string
+	var checks []*serverCheck
+	for _, ns := range delegation {
+		addrs := glue[ns]
+		resolved, err := lookupAddrs(resolver, ns, want4, want6)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("unable to look up addresses for %s: %v", ns, err))
+		}
+		for _, addr := range resolved {
+			if !contains(addrs, addr) {
+				if len(glue[ns]) > 0 {
+					problems = append(problems, fmt.Sprintf("glue mismatch: %s resolves to %s, which isn't in the parent's glue", ns, addr))
+				}
+				addrs = append(addrs, addr)
+			}
+		}
+		if len(addrs) == 0 {
+			problems = append(problems, fmt.Sprintf("lame delegation: %s has no addresses", ns))
+		}
+		for _, addr := range addrs {
+			checks = append(checks, &serverCheck{name: ns, addr: addr})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check *serverCheck) {
+			defer wg.Done()
+			check.run(zone, net.JoinHostPort(check.addr, *port), *timeout)
+		}(check)
+	}
+	wg.Wait()
+
+	printServerChecks(checks)
+	problems = append(problems, findProblems(zone, delegation, checks)...)
+
+	fmt.Println()
+	if len(problems) == 0 {
+		fmt.Println("no problems found")
+		return nil
+	}
+	fmt.Println("problems:")
+	for _, problem := range problems {
+		fmt.Printf("  - %s\n", problem)
+	}
+	return fmt.Errorf("found %d problems with %s", len(problems), zone)
+}
+
+// findParent walks up from the zone until the resolver has an NS set for a
+// name, which is the closest zone cut above it.
+func findParent(resolver *Client, zone string) (string, []string, error) {
+	labels, err := splitName(zone)
+	if err != nil {
+		return "", nil, err
+	}
+	for i := 1; i <= len(labels); i++ {
+		candidate := joinLabels(labels[i:])
+		msg, err := resolver.Query(candidate, TypeNS)
+		if err != nil {
+			return "", nil, fmt.Errorf("unable to look up NS for %s: %w", candidate, err)
+		}
+		ns := recordsData(msg.Answers, candidate, TypeNS)
+		if len(ns) > 0 {
+			return candidate, ns, nil
+		}
+	}
+	return "", nil, fmt.Errorf("unable to find the parent zone of %s", zone)
+}
+
+// findDelegation asks the parent's servers for the zone's NS set, and
+// returns it along with any glue and which server it came from.
+func findDelegation(resolver *Client, zone string, parentServers []string, port string, timeout time.Duration, want4, want6 bool) ([]string, map[string][]string, string, error) {
+	var lastErr error
+	for _, server := range parentServers {
+		addrs, err := lookupAddrs(resolver, server, want4, want6)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, addr := range addrs {
+			client, err := NewClient(TransportUDP, net.JoinHostPort(addr, port), timeout)
+			if err != nil {
+				return nil, nil, "", err
+			}
+			client.Options.NoRecursion = true
+			msg, err := client.Query(zone, TypeNS)
+			client.Close()
+			if err != nil {
+				lastErr = fmt.Errorf("%s (%s): %w", server, addr, err)
+				continue
+			}
+			if msg.Rcode() != RcodeSuccess {
+				lastErr = fmt.Errorf("%s (%s) answered %s", server, addr, rcodeString(msg.Rcode()))
+				continue
+			}
+
+			// usually a referral, but the parent's servers might also
+			// serve the zone itself
+			ns := recordsData(msg.Authorities, zone, TypeNS)
+			if len(ns) == 0 {
+				ns = recordsData(msg.Answers, zone, TypeNS)
+			}
+			if len(ns) == 0 {
+				lastErr = fmt.Errorf("%s (%s) has no delegation for %s", server, addr, zone)
+				continue
+			}
+			sort.Strings(ns)
+
+			glue := make(map[string][]string)
+			for _, rr := range msg.Additionals {
+				name := canonicalName(rr.NAME)
+				if contains(ns, name) && ((rr.TYPE == TypeA && want4) || (rr.TYPE == TypeAAAA && want6)) {
+					glue[name] = append(glue[name], rr.Data)
+				}
+			}
+			return ns, glue, fmt.Sprintf("%s (%s)", server, addr), nil
+		}
+	}
+	return nil, nil, "", fmt.Errorf("unable to get the delegation for %s from its parent: %w", zone, lastErr)
+}
+
+func lookupAddrs(resolver *Client, name string, want4, want6 bool) ([]string, error) {
+	var addrs []string
+	for _, qtype := range []uint16{TypeA, TypeAAAA} {
+		if (qtype == TypeA && !want4) || (qtype == TypeAAAA && !want6) {
+			continue
+		}
+		msg, err := resolver.Query(name, qtype)
+		if err != nil {
+			return nil, fmt.Errorf("unable to look up %s for %s: %w", typeString(qtype), name, err)
+		}
+		for _, rr := range msg.Answers {
+			if rr.TYPE == qtype {
+				addrs = append(addrs, rr.Data)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// recordsData returns the canonical data of the records with the given name
+// and type.
+func recordsData(records []DNSResourceRecord, name string, rrtype uint16) []string {
+	var data []string
+	for _, rr := range records {
+		if rr.TYPE == rrtype && canonicalName(rr.NAME) == name {
+			data = append(data, canonicalName(rr.Data))
+		}
+	}
+	return data
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *serverCheck) run(zone, server string, timeout time.Duration) {
+	udp, _ := NewClient(TransportUDP, server, timeout)
+	defer udp.Close()
+	udp.Options.NoRecursion = true
+
+	msg, err := udp.Query(zone, TypeSOA)
+	if err != nil {
+		s.err = err
+		return
+	}
+	s.rcode = msg.Rcode()
+	s.aa = msg.Header.AA == 1
+	for _, rr := range msg.Answers {
+		if rr.TYPE == TypeSOA && canonicalName(rr.NAME) == zone {
+			if _, err := fmt.Sscanf(soaSerialField(rr.Data), "%d", &s.serial); err == nil {
+				s.hasSerial = true
+			}
+		}
+	}
+
+	if msg, err = udp.Query(zone, TypeNS); err != nil {
+		s.nsErr = err
+	} else {
+		s.ns = recordsData(msg.Answers, zone, TypeNS)
+		sort.Strings(s.ns)
+	}
+
+	tcp, _ := NewClient(TransportTCP, server, timeout)
+	defer tcp.Close()
+	tcp.Options.NoRecursion = true
+	if _, err := tcp.Query(zone, TypeSOA); err != nil {
+		s.tcpErr = err
+	}
+
+	s.ednsErr = checkEDNS(udp, zone)
+}
+
+// checkEDNS runs a couple of the basic EDNS compliance tests: a plain EDNS
+// query has to get an OPT record back, and an unknown EDNS version has to
+// get BADVERS.
+func checkEDNS(client *Client, zone string) error {
+	client.Options = QueryOptions{NoRecursion: true, EDNS: true}
+	msg, err := client.Query(zone, TypeSOA)
+	if err != nil {
+		return fmt.Errorf("no answer to an EDNS query: %w", err)
+	}
+	if msg.Rcode() != RcodeSuccess {
+		return fmt.Errorf("answered an EDNS query with %s", rcodeString(msg.Rcode()))
+	}
+	if msg.OPT() == nil {
+		return errors.New("no OPT record in the answer to an EDNS query")
+	}
+
+	client.Options.EDNSVersion = 1
+	msg, err = client.Query(zone, TypeSOA)
+	if err != nil {
+		return fmt.Errorf("no answer to an EDNS version 1 query: %w", err)
+	}
+	if msg.Rcode() != RcodeBadVersion {
+		return fmt.Errorf("answered an EDNS version 1 query with %s instead of BADVERS", rcodeString(msg.Rcode()))
+	}
+	if opt := msg.OPT(); opt == nil || ednsVersion(opt) != 0 {
+		return errors.New("BADVERS answer doesn't have a version 0 OPT record")
+	}
+	return nil
+}
+
+// soaSerialField picks the serial out of SOA data in presentation format.
+func soaSerialField(data string) string {
+	fields := strings.Fields(data)
+	if len(fields) < 3 {
+		return ""
+	}
+	return fields[2]
+}
+
+func printServerChecks(checks []*serverCheck) {
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESERVER\tADDRESS\tRCODE\tAA\tSERIAL\tTCP\tEDNS")
+	for _, check := range checks {
+		if check.err != nil {
+			fmt.Fprintf(w, "%s\t%s\tERROR\t\t\t\t\n", check.name, check.addr)
+			continue
+		}
+		serial := "-"
+		if check.hasSerial {
+			serial = fmt.Sprint(check.serial)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", check.name, check.addr, rcodeString(check.rcode),
+			yesNo(check.aa), serial, okFailed(check.tcpErr), okFailed(check.ednsErr))
+	}
+	w.Flush()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func okFailed(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "ok"
+}
+
+func findProblems(zone string, delegation []string, checks []*serverCheck) []string {
+	var problems []string
+	serials := make(map[uint32][]string)
+	for _, check := range checks {
+		switch {
+		case check.err != nil:
+			problems = append(problems, fmt.Sprintf("lame delegation: %s did not answer: %v", check, check.err))
+			continue
+		case check.rcode != RcodeSuccess:
+			problems = append(problems, fmt.Sprintf("lame delegation: %s answered %s for %s SOA", check, rcodeString(check.rcode), zone))
+			continue
+		case !check.hasSerial:
+			problems = append(problems, fmt.Sprintf("lame delegation: %s has no SOA for %s", check, zone))
+			continue
+		}
+
+		if !check.aa {
+			problems = append(problems, fmt.Sprintf("missing AA flag: %s", check))
+		}
+		serials[check.serial] = append(serials[check.serial], check.String())
+
+		if check.nsErr != nil {
+			problems = append(problems, fmt.Sprintf("unable to get NS from %s: %v", check, check.nsErr))
+		} else if strings.Join(check.ns, " ") != strings.Join(delegation, " ") {
+			problems = append(problems, fmt.Sprintf("parent/child NS mismatch: parent has [%s], %s has [%s]",
+				strings.Join(delegation, " "), check, strings.Join(check.ns, " ")))
+		}
+		if check.tcpErr != nil {
+			problems = append(problems, fmt.Sprintf("TCP unavailable: %s: %v", check, check.tcpErr))
+		}
+		if check.ednsErr != nil {
+			problems = append(problems, fmt.Sprintf("EDNS non-compliance: %s: %v", check, check.ednsErr))
+		}
+	}
+
+	if len(serials) > 1 {
+		var drift []string
+		for serial, servers := range serials {
+			drift = append(drift, fmt.Sprintf("%d on %s", serial, strings.Join(servers, ", ")))
+		}
+		sort.Strings(drift)
+		problems = append(problems, "serial drift: "+strings.Join(drift, "; "))
+	}
+	return problems
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindProblems(t *testing.T) {
+	delegation := []string{"ns1.example.", "ns2.example."}
+	good := func(name, addr string, serial uint32) *serverCheck {
+		return &serverCheck{name: name, addr: addr, aa: true, hasSerial: true, serial: serial, ns: delegation}
+	}
+	// one healthy server with something changed
+	with := func(change func(c *serverCheck)) []*serverCheck {
+		c := good("ns1.example.", "192.0.2.1", 1)
+		change(c)
+		return []*serverCheck{c}
+	}
+	tests := []struct {
+		name     string
+		checks   []*serverCheck
+		problems []string // the start of each problem
+	}{
+		{"healthy", []*serverCheck{good("ns1.example.", "192.0.2.1", 1), good("ns2.example.", "192.0.2.2", 1)}, nil},
+		{"no answer", []*serverCheck{{name: "ns1.example.", addr: "192.0.2.1", err: errors.New("i/o timeout")}},
+			[]string{"lame delegation: ns1.example. (192.0.2.1) did not answer"}},
+		{"refused", []*serverCheck{{name: "ns1.example.", addr: "192.0.2.1", rcode: RcodeRefused}},
+			[]string{"lame delegation: ns1.example. (192.0.2.1) answered REFUSED"}},
+		{"no soa", []*serverCheck{{name: "ns1.example.", addr: "192.0.2.1"}},
+			[]string{"lame delegation: ns1.example. (192.0.2.1) has no SOA"}},
+		{"no aa", with(func(c *serverCheck) { c.aa = false }),
+			[]string{"missing AA flag: ns1.example. (192.0.2.1)"}},
+		{"ns mismatch", with(func(c *serverCheck) { c.ns = delegation[:1] }),
+			[]string{"parent/child NS mismatch: parent has [ns1.example. ns2.example.], ns1.example. (192.0.2.1) has [ns1.example.]"}},
+		{"ns error", with(func(c *serverCheck) { c.nsErr = errors.New("i/o timeout") }),
+			[]string{"unable to get NS from ns1.example. (192.0.2.1)"}},
+		{"no tcp", with(func(c *serverCheck) { c.tcpErr = errors.New("connection refused") }),
+			[]string{"TCP unavailable: ns1.example. (192.0.2.1)"}},
+		{"no edns", with(func(c *serverCheck) { c.ednsErr = errors.New("no OPT record") }),
+			[]string{"EDNS non-compliance: ns1.example. (192.0.2.1)"}},
+		{"serial drift", []*serverCheck{good("ns1.example.", "192.0.2.1", 2), good("ns2.example.", "192.0.2.2", 1), good("ns2.example.", "2001:db8::2", 1)},
+			[]string{"serial drift: 1 on ns2.example. (192.0.2.2), ns2.example. (2001:db8::2); 2 on ns1.example. (192.0.2.1)"}},
+	}
+	for _, tt := range tests {
+		problems := findProblems("example.", delegation, tt.checks)
+		if len(problems) != len(tt.problems) {
+			t.Errorf("%s: got problems %q", tt.name, problems)
+			continue
+		}
+		for i, problem := range problems {
+			if !strings.HasPrefix(problem, tt.problems[i]) {
+				t.Errorf("%s: got %q, want %q", tt.name, problem, tt.problems[i])
+			}
+		}
+	}
+}
+
+// withEDNS answers EDNS queries the way RFC 6891 says to: with an OPT record,
+// and with BADVERS for versions other than 0.
+func withEDNS(answer func(query *DNSMessage) *DNSMessage) func(query *DNSMessage) *DNSMessage {
+	return func(query *DNSMessage) *DNSMessage {
+		opt := query.OPT()
+		if opt == nil {
+			return answer(query)
+		}
+		var resp *DNSMessage
+		ttl := uint32(0)
+		if ednsVersion(opt) != 0 {
+			resp = &DNSMessage{Header: DNSHeader{ID: query.Header.ID, QR: 1, RCODE: RcodeBadVersion & 0xf}, Questions: query.Questions}
+			ttl = uint32(RcodeBadVersion>>4) << 24
+		} else {
+			resp = answer(query)
+		}
+		resp.Additionals = append(resp.Additionals, DNSResourceRecord{NAME: ".", TYPE: TypeOPT, CLASS: DefaultUDPSize, TTL: ttl})
+		return resp
+	}
+}
+
+func TestServerCheck(t *testing.T) {
+	zone := &fakeZone{name: "example.", records: []DNSResourceRecord{
+		testRR(t, "example.", TypeSOA, "ns1.example. hostmaster.example. 2024010101 3600 600 86400 60"),
+		testRR(t, "example.", TypeNS, "ns2.example."),
+		testRR(t, "example.", TypeNS, "ns1.example."),
+	}}
+	notAuthoritative := func(query *DNSMessage) *DNSMessage {
+		resp := zone.answer(query)
+		resp.Header.AA = 0
+		return resp
+	}
+	refused := func(query *DNSMessage) *DNSMessage {
+		return &DNSMessage{Header: DNSHeader{ID: query.Header.ID, QR: 1, RCODE: RcodeRefused}, Questions: query.Questions}
+	}
+	ignoresVersion := func(query *DNSMessage) *DNSMessage {
+		resp := zone.answer(query)
+		if query.OPT() != nil {
+			resp.Additionals = append(resp.Additionals, DNSResourceRecord{NAME: ".", TYPE: TypeOPT, CLASS: DefaultUDPSize})
+		}
+		return resp
+	}
+
+	tests := []struct {
+		name     string
+		server   string
+		problems []string
+	}{
+		{"healthy", serveFake(t, "127.0.0.1:0", withEDNS(zone.answer)), nil},
+		{"udp only", serveFakeUDP(t, "127.0.0.1:0", withEDNS(zone.answer)), []string{"TCP unavailable"}},
+		{"no edns", serveFake(t, "127.0.0.1:0", zone.answer), []string{"EDNS non-compliance: ns1.example. (192.0.2.1): no OPT record"}},
+		{"no badvers", serveFake(t, "127.0.0.1:0", ignoresVersion), []string{"EDNS non-compliance: ns1.example. (192.0.2.1): answered an EDNS version 1 query with NOERROR"}},
+		{"no aa", serveFake(t, "127.0.0.1:0", withEDNS(notAuthoritative)), []string{"missing AA flag"}},
+		{"refused", serveFake(t, "127.0.0.1:0", refused), []string{"lame delegation: ns1.example. (192.0.2.1) answered REFUSED"}},
+	}
+	for _, tt := range tests {
+		check := &serverCheck{name: "ns1.example.", addr: "192.0.2.1"}
+		check.run("example.", tt.server, 500*time.Millisecond)
+		if tt.problems == nil && (check.serial != 2024010101 || strings.Join(check.ns, " ") != "ns1.example. ns2.example.") {
+			t.Errorf("%s: got serial %d and NS %v", tt.name, check.serial, check.ns)
+		}
+		problems := findProblems("example.", []string{"ns1.example.", "ns2.example."}, []*serverCheck{check})
+		if len(problems) != len(tt.problems) {
+			t.Errorf("%s: got problems %q", tt.name, problems)
+			continue
+		}
+		for i, problem := range problems {
+			if !strings.HasPrefix(problem, tt.problems[i]) {
+				t.Errorf("%s: got %q, want %q", tt.name, problem, tt.problems[i])
+			}
+		}
+	}
+}
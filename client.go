@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TransportUDP   = "udp"
+	TransportTCP   = "tcp"
+	TransportTLS   = "tls"
+	TransportHTTPS = "https"
+)
+
+// Client sends packed queries to a single server and returns the packed
+// responses. Connections for the stream transports are opened on first use
+// and reused until an error closes them, so a Client is not safe for
+// concurrent use.
+type Client struct {
+	Transport string
+	Server    string
+	Timeout   time.Duration
+	Options   QueryOptions
+
+	conn net.Conn
+	http *http.Client
+	tls  *tls.Config
+}
+
+func NewClient(transport, server string, timeout time.Duration) (*Client, error) {
+	c := &Client{Transport: transport, Timeout: timeout}
+	switch transport {
+	case TransportUDP, TransportTCP:
+		c.Server = withDefaultPort(server, "53")
+	case TransportTLS:
+		c.Server = withDefaultPort(server, "853")
+		// the certificate is for the name we were given, not the address
+		// it gets looked up to
+		host, _, _ := net.SplitHostPort(c.Server)
+		c.tls = &tls.Config{ServerName: host}
+	case TransportHTTPS:
+		c.Server = server
+		if !strings.HasPrefix(server, "https://") {
+			c.Server = "https://" + server + "/dns-query"
+		}
+		c.http = &http.Client{Timeout: timeout}
+	default:
+		return nil, fmt.Errorf("unknown transport '%s'", transport)
+	}
+	return c, nil
+}
+
+func withDefaultPort(server, port string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	server = strings.TrimSuffix(strings.TrimPrefix(server, "["), "]")
+	return net.JoinHostPort(server, port)
+}
+
+// isTimeout reports whether err means the server never answered, as opposed
+// to answering badly or refusing the connection.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (c *Client) Exchange(query []byte) ([]byte, error) {
+	if len(query) < DNSHeaderLength {
+		return nil, fmt.Errorf("query is only %d bytes", len(query))
+	}
+	if c.Transport == TransportHTTPS {
+		return c.exchangeHTTPS(query)
+	}
+
+	if c.conn == nil {
+		addrs, err := c.serverAddrs()
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) > 1 {
+			return c.exchangeEyeballs(addrs, query)
+		}
+		if c.conn, err = c.dial(addrs[0]); err != nil {
+			return nil, err
+		}
+	}
+	c.conn.SetDeadline(time.Now().Add(c.Timeout))
+
+	var resp []byte
+	var err error
+	if c.Transport == TransportUDP {
+		resp, err = exchangeUDP(c.conn, query)
+	} else {
+		resp, err = c.exchangeStream(query)
+	}
+	if err != nil {
+		// a stream may be left halfway through a message, and a udp socket
+		// may still receive the answer to this query later on
+		c.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// serverAddrs looks up the addresses of the server, if it's a name.
+func (c *Client) serverAddrs() ([]string, error) {
+	host, port, err := net.SplitHostPort(c.Server)
+	if err != nil || net.ParseIP(host) != nil {
+		return []string{c.Server}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up dns server: %w", err)
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+	return addrs, nil
+}
+
+func (c *Client) dial(addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch c.Transport {
+	case TransportUDP, TransportTCP:
+		conn, err = net.DialTimeout(c.Transport, addr, c.Timeout)
+	case TransportTLS:
+		dialer := &net.Dialer{Timeout: c.Timeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, c.tls)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial dns server: %w", err)
+	}
+	return conn, nil
+}
+
+// exchangeEyeballs tries each of the server's addresses Happy Eyeballs
+// style, and keeps the connection to the first that works. Over udp there's
+// no handshake to tell a dead address by, so the query goes to each address
+// in turn and the first to answer wins; over the stream transports the
+// first to connect does.
+func (c *Client) exchangeEyeballs(addrs []string, query []byte) ([]byte, error) {
+	type attempt struct {
+		addr string
+		conn net.Conn
+		resp []byte
+		err  error
+	}
+	addrs = interleave(addrs)
+	results := make(chan attempt, len(addrs))
+	var mu sync.Mutex
+	var conns []net.Conn
+	done := false
+	try := func(addr string) {
+		conn, err := c.dial(addr)
+		var resp []byte
+		if err == nil {
+			mu.Lock()
+			if done {
+				conn.Close()
+				mu.Unlock()
+				return
+			}
+			conns = append(conns, conn)
+			mu.Unlock()
+			if c.Transport == TransportUDP {
+				conn.SetDeadline(time.Now().Add(c.Timeout))
+				resp, err = exchangeUDP(conn, query)
+			}
+		}
+		results <- attempt{addr, conn, resp, err}
+	}
+
+	var winner *attempt
+	var lastErr error
+	next, waiting := 0, 0
+	finished := make(map[string]bool)
+	for winner == nil && (next < len(addrs) || waiting > 0) {
+		var delay <-chan time.Time
+		if next < len(addrs) {
+			if waiting == 0 {
+				go try(addrs[next])
+				next++
+				waiting++
+				continue
+			}
+			delay = time.After(attemptDelay)
+		}
+		select {
+		case <-delay:
+			go try(addrs[next])
+			next++
+			waiting++
+		case a := <-results:
+			waiting--
+			finished[a.addr] = true
+			if a.err != nil {
+				families.failed(a.addr)
+				lastErr = a.err
+				continue
+			}
+			families.worked(a.addr)
+			winner = &a
+		}
+	}
+	if winner != nil {
+		// anything tried before the winner that still hasn't answered
+		// counts against its family
+		for _, addr := range addrs[:next] {
+			if addr == winner.addr {
+				break
+			}
+			if !finished[addr] {
+				families.failed(addr)
+			}
+		}
+	}
+
+	// the others lost, so hang up on them
+	mu.Lock()
+	done = true
+	for _, conn := range conns {
+		if winner == nil || conn != winner.conn {
+			conn.Close()
+		}
+	}
+	mu.Unlock()
+	if winner == nil {
+		return nil, lastErr
+	}
+
+	c.conn = winner.conn
+	if c.Transport == TransportUDP {
+		return winner.resp, nil
+	}
+	c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	resp, err := c.exchangeStream(query)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func exchangeUDP(conn net.Conn, query []byte) ([]byte, error) {
+	n, err := conn.Write(query)
+	if err != nil {
+		return nil, fmt.Errorf("error writing request to network: %w", err)
+	} else if n != len(query) {
+		return nil, errors.New("unable to write full request")
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, err = conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("error reading response from network: %w", err)
+		}
+		// skip anything that isn't an answer to this query, like late
+		// answers to earlier queries that timed out
+		if n >= DNSHeaderLength && bytes.Equal(buf[:2], query[:2]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+func (c *Client) exchangeStream(query []byte) ([]byte, error) {
+	// stream transports prefix each message with its length
+	packet := binary.BigEndian.AppendUint16(make([]byte, 0, len(query)+2), uint16(len(query)))
+	packet = append(packet, query...)
+	if _, err := c.conn.Write(packet); err != nil {
+		return nil, fmt.Errorf("error writing request to network: %w", err)
+	}
+
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(c.conn, length); err != nil {
+		return nil, fmt.Errorf("error reading response from network: %w", err)
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(c.conn, buf); err != nil {
+		return nil, fmt.Errorf("error reading response from network: %w", err)
+	}
+	if len(buf) < DNSHeaderLength || !bytes.Equal(buf[:2], query[:2]) {
+		return nil, errors.New("response does not match query")
+	}
+	return buf, nil
+}
+
+func (c *Client) exchangeHTTPS(query []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, c.Server, bytes.NewReader(query))
+	if err != nil {
+		return nil, fmt.Errorf("unable to build https request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending https request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("https request failed: %s", resp.Status)
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, fmt.Errorf("error reading https response: %w", err)
+	}
+	if len(buf) < DNSHeaderLength || !bytes.Equal(buf[:2], query[:2]) {
+		return nil, errors.New("response does not match query")
+	}
+	return buf, nil
+}
+
+// newClientForSpec builds a client from a dig style server argument like
+// @192.0.2.1, optionally with a tcp://, tls:// or https:// scheme to pick
+// the transport for just that server.
+func newClientForSpec(spec, transport string, timeout time.Duration) (*Client, error) {
+	server := strings.TrimPrefix(spec, "@")
+	for _, t := range []string{TransportUDP, TransportTCP, TransportTLS} {
+		if strings.HasPrefix(server, t+"://") {
+			return NewClient(t, strings.TrimPrefix(server, t+"://"), timeout)
+		}
+	}
+	if strings.HasPrefix(server, "https://") {
+		return NewClient(TransportHTTPS, server, timeout)
+	}
+	return NewClient(transport, server, timeout)
+}
+
+// Query sends a recursive query and decodes the response, retrying over tcp
+// when a udp response comes back truncated, and without EDNS when the server
+// doesn't do it and Options.EDNSFallback is set.
+func (c *Client) Query(name string, qtype uint16) (*DNSMessage, error) {
+	query, err := newQuery(name, qtype, c.Options)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := c.Exchange(query)
+	if err != nil {
+		return nil, err
+	}
+	msg := &DNSMessage{}
+	if err := msg.Unpack(buf); err != nil {
+		return nil, fmt.Errorf("unable to unpack response: %w", err)
+	}
+
+	// servers that don't know EDNS answer FORMERR or NOTIMP without an OPT
+	// record (RFC 6891 section 7)
+	rcode := msg.Rcode()
+	if c.Options.EDNS && c.Options.EDNSFallback && msg.OPT() == nil &&
+		(rcode == RcodeFormatError || rcode == RcodeNotImplemented) {
+		opts := c.Options
+		c.Options = QueryOptions{NoRecursion: opts.NoRecursion}
+		defer func() { c.Options = opts }()
+		return c.Query(name, qtype)
+	}
+
+	if msg.Header.TC == 1 && c.Transport == TransportUDP {
+		tcp := &Client{Transport: TransportTCP, Server: c.Server, Timeout: c.Timeout, Options: c.Options}
+		defer tcp.Close()
+		return tcp.Query(name, qtype)
+	}
+	return msg, nil
+}
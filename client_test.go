@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testZone(t *testing.T) *fakeZone {
+	return &fakeZone{name: "example.", records: []DNSResourceRecord{
+		testRR(t, "example.", TypeSOA, "ns.example. hostmaster.example. 1 3600 600 86400 60"),
+		testRR(t, "www.example.", TypeA, "192.0.2.1"),
+	}}
+}
+
+// serveDoH answers DNS over HTTPS POSTs with answer, and returns the server,
+// whose certificate is for 127.0.0.1.
+func serveDoH(t *testing.T, answer func(query *DNSMessage) *DNSMessage) *httptest.Server {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		buf, _ := io.ReadAll(r.Body)
+		resp := fakeResponse(t, buf, answer)
+		if resp == nil {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestClientTransports(t *testing.T) {
+	zone := testZone(t)
+	udp := serveFake(t, "127.0.0.1:0", zone.answer)
+
+	doh := serveDoH(t, zone.answer)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", doh.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveFakeStream(t, l, zone.answer)
+	roots := x509.NewCertPool()
+	roots.AddCert(doh.Certificate())
+
+	tests := []struct {
+		transport string
+		server    string
+	}{
+		{TransportUDP, udp},
+		{TransportTCP, udp},
+		{TransportTLS, l.Addr().String()},
+		{TransportHTTPS, doh.URL + "/dns-query"},
+	}
+	for _, tt := range tests {
+		client, err := NewClient(tt.transport, tt.server, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.tls != nil {
+			client.tls.RootCAs = roots
+		}
+		if client.http != nil {
+			client.http = doh.Client()
+		}
+		// twice, so the second goes over any connection the first opened
+		for i := 0; i < 2; i++ {
+			msg, err := client.Query("www.example.", TypeA)
+			if err != nil {
+				t.Errorf("%s: %v", tt.transport, err)
+				continue
+			}
+			if len(msg.Answers) != 1 || msg.Answers[0].Data != "192.0.2.1" {
+				t.Errorf("%s got:\n%s", tt.transport, msg)
+			}
+		}
+		client.Close()
+	}
+}
+
+func TestClientTLSVerifiesCertificate(t *testing.T) {
+	doh := serveDoH(t, testZone(t).answer)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", doh.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveFakeStream(t, l, testZone(t).answer)
+
+	client, err := NewClient(TransportTLS, l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Query("www.example.", TypeA); err == nil {
+		t.Error("got an answer from a server with an untrusted certificate")
+	}
+}
+
+func TestClientRetriesTruncatedOverTCP(t *testing.T) {
+	zone := testZone(t)
+	addr := serveFakeUDP(t, "127.0.0.1:0", func(query *DNSMessage) *DNSMessage {
+		return &DNSMessage{Header: DNSHeader{ID: query.Header.ID, QR: 1, AA: 1, TC: 1}, Questions: query.Questions}
+	})
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveFakeStream(t, l, zone.answer)
+
+	client, err := NewClient(TransportUDP, addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	msg, err := client.Query("www.example.", TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.TC == 1 || len(msg.Answers) != 1 {
+		t.Errorf("got:\n%s", msg)
+	}
+}
+
+func TestClientSkipsStaleUDPResponses(t *testing.T) {
+	zone := testZone(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resp := fakeResponse(t, buf[:n], zone.answer)
+		// an answer to some earlier query first, then the real one
+		stale := append([]byte{}, resp...)
+		stale[0]++
+		pc.WriteTo(stale, from)
+		pc.WriteTo(resp, from)
+	}()
+
+	client, err := NewClient(TransportUDP, pc.LocalAddr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	query, _ := newQuery("www.example.", TypeA, QueryOptions{})
+	resp, err := client.Exchange(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp[:2], query[:2]) {
+		t.Errorf("got the response with id % x for the query with id % x", resp[:2], query[:2])
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	if _, err := NewClient("quic", "127.0.0.1", time.Second); err == nil {
+		t.Error("made a client for an unknown transport")
+	}
+
+	doh := serveDoH(t, testZone(t).answer)
+	client, err := NewClient(TransportHTTPS, doh.URL+"/dns-query", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.http = doh.Client()
+	if _, err := client.Exchange([]byte{0, 1, 2}); err == nil {
+		t.Error("sent a query shorter than a header")
+	}
+	// the fake server answers garbage with a 400
+	if _, err := client.Exchange(make([]byte, DNSHeaderLength+1)); err == nil {
+		t.Error("got an answer to a bad query")
+	}
+
+	// nothing's listening, so this is refused or times out
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	client, err = NewClient(TransportTCP, addr, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Query("www.example.", TypeA); err == nil {
+		t.Error("got an answer from a server that isn't there")
+	}
+}
+
+func TestNewClientForSpec(t *testing.T) {
+	tests := []struct {
+		spec      string
+		transport string
+		server    string
+	}{
+		{"@192.0.2.1", TransportUDP, "192.0.2.1:53"},
+		{"@192.0.2.1:5353", TransportUDP, "192.0.2.1:5353"},
+		{"@2001:db8::1", TransportUDP, "[2001:db8::1]:53"},
+		{"@[2001:db8::1]:5353", TransportUDP, "[2001:db8::1]:5353"},
+		{"@tcp://192.0.2.1", TransportTCP, "192.0.2.1:53"},
+		{"@tls://dns.example", TransportTLS, "dns.example:853"},
+		{"@https://dns.example/dns-query", TransportHTTPS, "https://dns.example/dns-query"},
+	}
+	for _, tt := range tests {
+		client, err := newClientForSpec(tt.spec, TransportUDP, time.Second)
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+		if client.Transport != tt.transport || client.Server != tt.server {
+			t.Errorf("%s: got %s %s, want %s %s", tt.spec, client.Transport, client.Server, tt.transport, tt.server)
+		}
+	}
+}
+
+func TestClientEDNSFallback(t *testing.T) {
+	zone := testZone(t)
+	// a server from before EDNS, which chokes on the OPT record
+	old := serveFake(t, "127.0.0.1:0", func(query *DNSMessage) *DNSMessage {
+		if query.OPT() != nil {
+			return &DNSMessage{Header: DNSHeader{ID: query.Header.ID, QR: 1, RCODE: RcodeFormatError}, Questions: query.Questions}
+		}
+		return zone.answer(query)
+	})
+	// and one that knows EDNS but really didn't like the query
+	formerr := serveFake(t, "127.0.0.1:0", withEDNS(func(query *DNSMessage) *DNSMessage {
+		return &DNSMessage{Header: DNSHeader{ID: query.Header.ID, QR: 1, RCODE: RcodeFormatError}, Questions: query.Questions}
+	}))
+
+	tests := []struct {
+		name     string
+		server   string
+		fallback bool
+		rcode    uint16
+	}{
+		{"fallback", old, true, RcodeSuccess},
+		{"no fallback", old, false, RcodeFormatError},
+		{"formerr with opt", formerr, true, RcodeFormatError},
+	}
+	for _, tt := range tests {
+		client, err := NewClient(TransportUDP, tt.server, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Options = QueryOptions{EDNS: true, NSID: true, EDNSFallback: tt.fallback}
+		msg, err := client.Query("www.example.", TypeA)
+		client.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if msg.Rcode() != tt.rcode {
+			t.Errorf("%s got:\n%s", tt.name, msg)
+		}
+		if !client.Options.EDNS {
+			t.Errorf("%s: the client was left without EDNS", tt.name)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+type compareResult struct {
+	server  string
+	msg     *DNSMessage
+	latency time.Duration
+	err     error
+}
+
+func compareMain(args []string) error {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	transport := flags.String("transport", TransportUDP, "transport for servers without a scheme: udp, tcp, tls or https")
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to wait for each server")
+	nsid := flags.Bool("nsid", false, "ask each server to identify itself with NSID (RFC 5001)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dunce compare [flags] name type @server1 @server2 ...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 4 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	name := flags.Arg(0)
+	qtype, err := parseType(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	servers := flags.Args()[2:]
+
+	clients := make([]*Client, len(servers))
+	for i, spec := range servers {
+		client, err := newClientForSpec(spec, *transport, *timeout)
+		if err != nil {
+			return err
+		}
+		client.Options.EDNS = true
+		client.Options.EDNSFallback = true
+		client.Options.NSID = *nsid
+		clients[i] = client
+	}
+
+	// the queries only start once every server is known to be usable
+	results := make([]compareResult, len(servers))
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		results[i].server = servers[i]
+		wg.Add(1)
+		go func(client *Client, result *compareResult) {
+			defer wg.Done()
+			defer client.Close()
+			start := time.Now()
+			result.msg, result.err = client.Query(name, qtype)
+			result.latency = time.Since(start)
+		}(client, &results[i])
+	}
+	wg.Wait()
+
+	if !printComparison(os.Stdout, results) {
+		return errors.New("servers disagree")
+	}
+	return nil
+}
+
+// normalizeRecord formats a record without its TTL, and with the parts that
+// are case insensitive lower cased, so that equal records compare equal.
+func normalizeRecord(rr *DNSResourceRecord) string {
+	data := rr.Data
+	switch rr.TYPE {
+	case TypeNS, TypeCNAME, TypePTR, TypeDNAME, TypeMX, TypeSRV, TypeSOA:
+		data = strings.ToLower(data)
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s", strings.ToLower(rr.NAME), classString(rr.CLASS), typeString(rr.TYPE), data)
+}
+
+// printComparison reports what each server said and where they differ, and
+// returns whether they all agree.
+func printComparison(out io.Writer, results []compareResult) bool {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tRCODE\tFLAGS\tANSWERS\tLATENCY")
+
+	var answered, failed []compareResult
+	for _, result := range results {
+		if result.err != nil {
+			fmt.Fprintf(w, "%s\tERROR\t\t\t%v\n", result.server, result.latency.Round(time.Microsecond))
+			failed = append(failed, result)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%v\n", result.server, rcodeString(result.msg.Rcode()),
+			result.msg.Header.Flags(), len(result.msg.Answers), result.latency.Round(time.Microsecond))
+		answered = append(answered, result)
+	}
+	w.Flush()
+	for _, result := range failed {
+		fmt.Fprintf(out, "%s: %v\n", result.server, result.err)
+	}
+	for _, result := range answered {
+		if nsid, ok := result.msg.NSID(); ok {
+			fmt.Fprintf(out, "%s: NSID %s\n", result.server, nsidString(nsid))
+		}
+		for _, e := range result.msg.ExtendedErrors() {
+			fmt.Fprintf(out, "%s: EDE %s\n", result.server, e)
+		}
+	}
+
+	// track which servers returned each normalized record
+	seen := make(map[string][]string)
+	for _, result := range answered {
+		for _, key := range uniqueRecords(result.msg.Answers) {
+			seen[key] = append(seen[key], result.server)
+		}
+	}
+	records := make([]string, 0, len(seen))
+	for key := range seen {
+		records = append(records, key)
+	}
+	sort.Strings(records)
+
+	var differences []string
+	if len(failed) > 0 {
+		differences = append(differences, "some servers did not answer")
+	}
+	if len(answered) > 0 {
+		first := answered[0].msg
+		for _, result := range answered[1:] {
+			if result.msg.Rcode() != first.Rcode() {
+				differences = append(differences, "rcodes differ")
+				break
+			}
+		}
+		for _, result := range answered[1:] {
+			if result.msg.Header.Flags() != first.Header.Flags() {
+				differences = append(differences, "flags differ")
+				break
+			}
+		}
+	}
+
+	if len(records) > 0 {
+		fmt.Fprintln(out)
+		w = tabwriter.NewWriter(out, 0, 8, 1, ' ', 0)
+		answersDiffer := false
+		for _, key := range records {
+			if len(seen[key]) == len(answered) {
+				fmt.Fprintf(w, "  %s\n", key)
+			} else {
+				fmt.Fprintf(w, "! %s\tonly %s\n", key, strings.Join(seen[key], " "))
+				answersDiffer = true
+			}
+		}
+		w.Flush()
+		if answersDiffer {
+			differences = append(differences, "answers differ")
+		}
+	}
+
+	fmt.Fprintln(out)
+	if len(differences) > 0 {
+		fmt.Fprintln(out, strings.Join(differences, ", "))
+		return false
+	}
+	fmt.Fprintln(out, "all servers agree")
+	return true
+}
+
+func uniqueRecords(records []DNSResourceRecord) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for i := range records {
+		key := normalizeRecord(&records[i])
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
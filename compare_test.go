@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNormalizeRecord(t *testing.T) {
+	short := testRR(t, "WWW.Example.", TypeCNAME, "Web.Example.")
+	short.TTL = 60
+	tests := []struct {
+		rr   DNSResourceRecord
+		want string
+	}{
+		{testRR(t, "www.example.", TypeA, "192.0.2.1"), "www.example.\tIN\tA\t192.0.2.1"},
+		{short, "www.example.\tIN\tCNAME\tweb.example."},
+		{testRR(t, "example.", TypeMX, "10 MX.example."), "example.\tIN\tMX\t10 mx.example."},
+		// TXT is case sensitive
+		{testRR(t, "Example.", TypeTXT, "Hello"), "example.\tIN\tTXT\t\"Hello\""},
+	}
+	for _, tt := range tests {
+		if got := normalizeRecord(&tt.rr); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.rr.String(), got, tt.want)
+		}
+	}
+}
+
+func TestPrintComparison(t *testing.T) {
+	a := testRR(t, "www.example.", TypeA, "192.0.2.1")
+	b := testRR(t, "www.example.", TypeA, "192.0.2.2")
+	// the same records another server might give: a different ttl, order
+	// and case
+	b2, a2 := b, a
+	b2.NAME, b2.TTL = "WWW.EXAMPLE.", 10
+	a2.TTL = 300
+	answer := func(rcode, aa uint16, answers ...DNSResourceRecord) *DNSMessage {
+		return &DNSMessage{Header: DNSHeader{QR: 1, RD: 1, RA: 1, AA: aa, RCODE: rcode}, Answers: answers}
+	}
+	tests := []struct {
+		name    string
+		results []compareResult
+		agree   bool
+		output  []string // parts of the output
+	}{
+		{"agree", []compareResult{
+			{server: "@one", msg: answer(RcodeSuccess, 0, a, b)},
+			{server: "@two", msg: answer(RcodeSuccess, 0, b2, a2)},
+		}, true, []string{"  www.example. IN A 192.0.2.1\n", "  www.example. IN A 192.0.2.2\n", "\nall servers agree\n"}},
+		{"rcodes", []compareResult{
+			{server: "@one", msg: answer(RcodeSuccess, 0)},
+			{server: "@two", msg: answer(RcodeNameError, 0)},
+		}, false, []string{"@two    NXDOMAIN", "\nrcodes differ\n"}},
+		{"flags", []compareResult{
+			{server: "@one", msg: answer(RcodeSuccess, 0, a)},
+			{server: "@two", msg: answer(RcodeSuccess, 1, a)},
+		}, false, []string{"\nflags differ\n"}},
+		{"answers", []compareResult{
+			{server: "@one", msg: answer(RcodeSuccess, 0, a, b)},
+			{server: "@two", msg: answer(RcodeSuccess, 0, a)},
+			{server: "@three", msg: answer(RcodeSuccess, 0, b)},
+		}, false, []string{"! www.example. IN A 192.0.2.1 only @one @two\n", "! www.example. IN A 192.0.2.2 only @one @three\n", "\nanswers differ\n"}},
+		{"no answer", []compareResult{
+			{server: "@one", msg: answer(RcodeSuccess, 0, a)},
+			{server: "@two", err: errors.New("i/o timeout")},
+		}, false, []string{"@two    ERROR", "@two: i/o timeout\n", "\nsome servers did not answer\n"}},
+		{"everything", []compareResult{
+			{server: "@one", msg: answer(RcodeSuccess, 0, a)},
+			{server: "@two", msg: answer(RcodeServerFailure, 1)},
+			{server: "@three", err: errors.New("i/o timeout")},
+		}, false, []string{"\nsome servers did not answer, rcodes differ, flags differ, answers differ\n"}},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if agree := printComparison(&out, tt.results); agree != tt.agree {
+			t.Errorf("%s: got agree %v", tt.name, agree)
+		}
+		for _, part := range tt.output {
+			if !strings.Contains(out.String(), part) {
+				t.Errorf("%s: no %q in:\n%s", tt.name, part, out.String())
+			}
+		}
+	}
+}
+
+func TestCompareBadServer(t *testing.T) {
+	var queries atomic.Int32
+	zone := testZone(t)
+	good := serveFake(t, "127.0.0.1:0", func(query *DNSMessage) *DNSMessage {
+		queries.Add(1)
+		return zone.answer(query)
+	})
+
+	// the second server falls back on the unknown transport
+	err := compareMain([]string{"-transport", "quic", "www.example.", "A", "@udp://" + good, "@" + good})
+	if err == nil || !strings.Contains(err.Error(), "quic") {
+		t.Errorf("got %v", err)
+	}
+	// long enough for a query that shouldn't have been sent to arrive
+	time.Sleep(100 * time.Millisecond)
+	if n := queries.Load(); n != 0 {
+		t.Errorf("queried the good server %d times before giving up", n)
+	}
+
+	var out string
+	out = captureStdout(t, func() {
+		err = compareMain([]string{"www.example.", "A", "@udp://" + good, "@tcp://" + good})
+	})
+	if err != nil || !strings.Contains(out, "all servers agree") {
+		t.Errorf("got %v and:\n%s", err, out)
+	}
+}
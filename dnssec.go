@@ -0,0 +1,767 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AlgorithmRSASHA256       = 8
+	AlgorithmRSASHA512       = 10
+	AlgorithmECDSAP256SHA256 = 13
+	AlgorithmECDSAP384SHA384 = 14
+	AlgorithmED25519         = 15
+
+	DigestSHA256 = 2
+	DigestSHA384 = 4
+
+	// DNSKEY flags
+	flagZoneKey = 0x0100
+	flagRevoked = 0x0080
+
+	// NSEC3 flags and the only hash there is
+	flagOptOut     = 0x01
+	nsec3HashSHA1  = 1
+	maxNSEC3Rounds = 150 // RFC 9276 lets validators ignore anything above this
+)
+
+// rootAnchors are the DS records of the root zone's key signing keys,
+// KSK-2017 and KSK-2024.
+var rootAnchors = []string{
+	"20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	"38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// errBogus is wrapped by every validation failure, so callers can tell a bad
+// signature apart from a server that didn't answer.
+var errBogus = errors.New("dnssec validation failed")
+
+var (
+	errSignatureExpired     = errors.New("signature expired")
+	errSignatureNotYetValid = errors.New("signature isn't valid yet")
+)
+
+// validationError is a validation failure, with the Extended DNS Error code
+// that best describes it.
+type validationError struct {
+	code uint16
+	msg  string
+}
+
+func (e *validationError) Error() string {
+	return errBogus.Error() + ": " + e.msg
+}
+
+func (e *validationError) Unwrap() error {
+	return errBogus
+}
+
+func bogus(code uint16, format string, args ...interface{}) error {
+	return &validationError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// parseDS builds a DS record from its presentation format RDATA, like
+// "20326 8 2 E06D44B8...".
+func parseDS(owner, s string) (DNSResourceRecord, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 4 {
+		return DNSResourceRecord{}, fmt.Errorf("DS record '%s' needs a key tag, algorithm, digest type and digest", s)
+	}
+	tag, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return DNSResourceRecord{}, fmt.Errorf("bad key tag in DS record '%s'", s)
+	}
+	alg, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return DNSResourceRecord{}, fmt.Errorf("bad algorithm in DS record '%s'", s)
+	}
+	digestType, err := strconv.ParseUint(fields[2], 10, 8)
+	if err != nil {
+		return DNSResourceRecord{}, fmt.Errorf("bad digest type in DS record '%s'", s)
+	}
+	digest, err := hex.DecodeString(strings.Join(fields[3:], ""))
+	if err != nil {
+		return DNSResourceRecord{}, fmt.Errorf("bad digest in DS record '%s'", s)
+	}
+
+	rdata := binary.BigEndian.AppendUint16(nil, uint16(tag))
+	rdata = append(rdata, byte(alg), byte(digestType))
+	rdata = append(rdata, digest...)
+	data, _ := rdataString(rdata, TypeDS)
+	return DNSResourceRecord{NAME: canonicalName(owner), TYPE: TypeDS, CLASS: ClassINET, RDATA: rdata, Data: data}, nil
+}
+
+// keyTag computes the tag a DS or RRSIG uses to refer to a DNSKEY, from the
+// key's RDATA (RFC 4034 appendix B).
+func keyTag(rdata []byte) uint16 {
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xffff
+	return uint16(ac)
+}
+
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case AlgorithmRSASHA256, AlgorithmRSASHA512, AlgorithmECDSAP256SHA256, AlgorithmECDSAP384SHA384, AlgorithmED25519:
+		return true
+	}
+	return false
+}
+
+// supportedDS reports whether we can check keys against a DS record. A zone
+// whose DS records are all unsupported is treated as unsigned (RFC 4035
+// section 5.2).
+func supportedDS(ds *DNSResourceRecord) bool {
+	if len(ds.RDATA) < 4 || !supportedAlgorithm(ds.RDATA[2]) {
+		return false
+	}
+	return ds.RDATA[3] == DigestSHA256 || ds.RDATA[3] == DigestSHA384
+}
+
+// dsMatches reports whether a DS record is a digest of the DNSKEY.
+func dsMatches(ds, key *DNSResourceRecord) bool {
+	if len(ds.RDATA) < 4 || len(key.RDATA) < 4 {
+		return false
+	}
+	if binary.BigEndian.Uint16(ds.RDATA) != keyTag(key.RDATA) || ds.RDATA[2] != key.RDATA[3] {
+		return false
+	}
+	owner, err := nameWire(key.NAME)
+	if err != nil {
+		return false
+	}
+	data := append(owner, key.RDATA...)
+	switch ds.RDATA[3] {
+	case DigestSHA256:
+		digest := sha256.Sum256(data)
+		return bytes.Equal(ds.RDATA[4:], digest[:])
+	case DigestSHA384:
+		digest := sha512.Sum384(data)
+		return bytes.Equal(ds.RDATA[4:], digest[:])
+	}
+	return false
+}
+
+// verifyRRset checks the RRset against the RRSIGs in sigs made by the
+// signer with one of the keys, and returns the RRSIG that checked out.
+func verifyRRset(rrset, sigs, keys []DNSResourceRecord, signer string, now time.Time) (*DNSResourceRecord, error) {
+	if len(rrset) == 0 {
+		return nil, errors.New("no records to verify")
+	}
+	owner, rrtype := canonicalName(rrset[0].NAME), rrset[0].TYPE
+	var lastErr error
+	for i := range sigs {
+		sig := &sigs[i]
+		if sig.TYPE != TypeRRSIG || canonicalName(sig.NAME) != owner || len(sig.RDATA) < 18 ||
+			binary.BigEndian.Uint16(sig.RDATA) != rrtype {
+			continue
+		}
+		signerName, _, err := unpackName(sig.RDATA, 18)
+		if err != nil || canonicalName(signerName) != signer {
+			continue
+		}
+		for j := range keys {
+			key := &keys[j]
+			if len(key.RDATA) < 4 || keyTag(key.RDATA) != binary.BigEndian.Uint16(sig.RDATA[16:]) {
+				continue
+			}
+			if err := verifyRRSIG(rrset, sig, key, now); err != nil {
+				lastErr = err
+				continue
+			}
+			return sig, nil
+		}
+	}
+	if lastErr != nil {
+		code := EDEDNSSECBogus
+		if errors.Is(lastErr, errSignatureExpired) {
+			code = EDESignatureExpired
+		} else if errors.Is(lastErr, errSignatureNotYetValid) {
+			code = EDESignatureNotYetValid
+		}
+		return nil, bogus(code, "%s %s: %v", owner, typeString(rrtype), lastErr)
+	}
+	return nil, bogus(EDERRSIGsMissing, "%s %s has no signature from %s", owner, typeString(rrtype), signer)
+}
+
+func verifyRRSIG(rrset []DNSResourceRecord, sig, key *DNSResourceRecord, now time.Time) error {
+	flags := binary.BigEndian.Uint16(key.RDATA)
+	if flags&flagZoneKey == 0 || flags&flagRevoked != 0 {
+		return errors.New("signed with a key that isn't a zone key")
+	}
+	if key.RDATA[3] != sig.RDATA[2] {
+		return errors.New("signature and key algorithms differ")
+	}
+
+	// serial number arithmetic, so the times work past 2106
+	t := uint32(now.Unix())
+	inception, expiration := binary.BigEndian.Uint32(sig.RDATA[12:]), binary.BigEndian.Uint32(sig.RDATA[8:])
+	if int32(t-inception) < 0 {
+		return fmt.Errorf("%w, not until %s", errSignatureNotYetValid, sigTimeString(inception))
+	}
+	if int32(expiration-t) < 0 {
+		return fmt.Errorf("%w at %s", errSignatureExpired, sigTimeString(expiration))
+	}
+
+	data, signature, err := signedData(rrset, sig)
+	if err != nil {
+		return err
+	}
+	return verifySignature(key.RDATA[3], key.RDATA[4:], data, signature)
+}
+
+// signedData builds what an RRSIG's signature covers: the RRSIG's own RDATA
+// up to the signature, then the RRset in canonical form and order (RFC 4034
+// section 3.1.8.1).
+func signedData(rrset []DNSResourceRecord, sig *DNSResourceRecord) ([]byte, []byte, error) {
+	signerEnd := skipWireName(sig.RDATA, 18)
+	if signerEnd < 0 {
+		return nil, nil, errors.New("bad signer name in RRSIG")
+	}
+	data := append([]byte{}, sig.RDATA[:18]...)
+	data = append(data, asciiLower(sig.RDATA[18:signerEnd])...)
+
+	labels, err := splitName(rrset[0].NAME)
+	if err != nil {
+		return nil, nil, err
+	}
+	sigLabels := int(sig.RDATA[3])
+	if sigLabels > len(labels) {
+		return nil, nil, errors.New("RRSIG has more labels than its owner")
+	}
+	if sigLabels < len(labels) {
+		// expanded from a wildcard, which is what got signed
+		labels = append([][]byte{[]byte("*")}, labels[len(labels)-sigLabels:]...)
+	}
+	owner, err := packName(joinLabels(labels))
+	if err != nil {
+		return nil, nil, err
+	}
+	owner = asciiLower(owner)
+
+	var rdatas [][]byte
+	for i := range rrset {
+		rdatas = append(rdatas, canonicalRDATA(&rrset[i]))
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+	for i, rdata := range rdatas {
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		data = append(data, owner...)
+		data = binary.BigEndian.AppendUint16(data, rrset[0].TYPE)
+		data = binary.BigEndian.AppendUint16(data, rrset[0].CLASS)
+		data = append(data, sig.RDATA[4:8]...) // the original ttl
+		data = binary.BigEndian.AppendUint16(data, uint16(len(rdata)))
+		data = append(data, rdata...)
+	}
+	return data, sig.RDATA[signerEnd:], nil
+}
+
+// canonicalRDATA lower cases the names in RDATA for the types RFC 4034
+// section 6.2 lists, less the ones RFC 6840 took back out.
+func canonicalRDATA(rr *DNSResourceRecord) []byte {
+	prefix, count := 0, 0
+	switch rr.TYPE {
+	case TypeNS, TypeCNAME, TypePTR, TypeDNAME:
+		count = 1
+	case TypeMX:
+		prefix, count = 2, 1
+	case TypeSRV:
+		prefix, count = 6, 1
+	case TypeSOA:
+		count = 2
+	default:
+		return rr.RDATA
+	}
+	end := prefix
+	for i := 0; i < count; i++ {
+		if end = skipWireName(rr.RDATA, end); end < 0 {
+			return rr.RDATA
+		}
+	}
+	rdata := append([]byte{}, rr.RDATA...)
+	copy(rdata[prefix:end], asciiLower(rdata[prefix:end]))
+	return rdata
+}
+
+func verifySignature(alg uint8, pubkey, data, signature []byte) error {
+	switch alg {
+	case AlgorithmRSASHA256, AlgorithmRSASHA512:
+		key, err := rsaPublicKey(pubkey)
+		if err != nil {
+			return err
+		}
+		hash := crypto.SHA256
+		if alg == AlgorithmRSASHA512 {
+			hash = crypto.SHA512
+		}
+		h := hash.New()
+		h.Write(data)
+		if err := rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), signature); err != nil {
+			return errors.New("bad RSA signature")
+		}
+		return nil
+	case AlgorithmECDSAP256SHA256, AlgorithmECDSAP384SHA384:
+		curve, size := elliptic.P256(), 32
+		if alg == AlgorithmECDSAP384SHA384 {
+			curve, size = elliptic.P384(), 48
+		}
+		if len(pubkey) != 2*size || len(signature) != 2*size {
+			return errors.New("bad ECDSA key or signature length")
+		}
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(pubkey[:size]),
+			Y:     new(big.Int).SetBytes(pubkey[size:]),
+		}
+		var digest []byte
+		if alg == AlgorithmECDSAP256SHA256 {
+			sum := sha256.Sum256(data)
+			digest = sum[:]
+		} else {
+			sum := sha512.Sum384(data)
+			digest = sum[:]
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("bad ECDSA signature")
+		}
+		return nil
+	case AlgorithmED25519:
+		if len(pubkey) != ed25519.PublicKeySize {
+			return errors.New("bad Ed25519 key length")
+		}
+		if !ed25519.Verify(pubkey, data, signature) {
+			return errors.New("bad Ed25519 signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %d", alg)
+}
+
+// rsaPublicKey decodes an RSA key in the RFC 3110 format: the exponent's
+// length, the exponent, then the modulus.
+func rsaPublicKey(buf []byte) (*rsa.PublicKey, error) {
+	if len(buf) < 1 {
+		return nil, errors.New("RSA key is empty")
+	}
+	length, off := int(buf[0]), 1
+	if length == 0 {
+		if len(buf) < 3 {
+			return nil, errors.New("RSA key is truncated")
+		}
+		length, off = int(binary.BigEndian.Uint16(buf[1:])), 3
+	}
+	if off+length >= len(buf) {
+		return nil, errors.New("RSA key is truncated")
+	}
+	e := new(big.Int).SetBytes(buf[off : off+length])
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, errors.New("RSA exponent is too large")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(buf[off+length:]), E: int(e.Int64())}, nil
+}
+
+// nameWire is a name in the lower cased wire format that digests and
+// hashes are computed over.
+func nameWire(name string) ([]byte, error) {
+	buf, err := packName(name)
+	if err != nil {
+		return nil, err
+	}
+	return asciiLower(buf), nil
+}
+
+// asciiLower lower cases just the ASCII letters, since label bytes aren't
+// necessarily UTF-8.
+func asciiLower(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		out[i] = c
+	}
+	return out
+}
+
+// skipWireName returns the offset just past an uncompressed name, or -1 if
+// there isn't one there.
+func skipWireName(buf []byte, off int) int {
+	for off < len(buf) {
+		l := int(buf[off])
+		if l == 0 {
+			return off + 1
+		}
+		if l > 63 {
+			return -1
+		}
+		off += 1 + l
+	}
+	return -1
+}
+
+func typeBitmapHas(bitmap []byte, rrtype uint16) bool {
+	window, bit := byte(rrtype>>8), int(rrtype&0xff)
+	for p := 0; p+2 <= len(bitmap); {
+		length := int(bitmap[p+1])
+		if p+2+length > len(bitmap) {
+			return false
+		}
+		if bitmap[p] == window {
+			return bit/8 < length && bitmap[p+2+bit/8]&(0x80>>(bit%8)) != 0
+		}
+		p += 2 + length
+	}
+	return false
+}
+
+// compareNames orders names canonically (RFC 4034 section 6.1): label by
+// label from the right, case insensitively.
+func compareNames(a, b string) int {
+	al, _ := splitName(a)
+	bl, _ := splitName(b)
+	for i := 1; i <= len(al) && i <= len(bl); i++ {
+		if c := bytes.Compare(asciiLower(al[len(al)-i]), asciiLower(bl[len(bl)-i])); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(al) < len(bl):
+		return -1
+	case len(al) > len(bl):
+		return 1
+	}
+	return 0
+}
+
+// commonAncestor returns the longest name both names are at or below.
+func commonAncestor(a, b string) string {
+	al, _ := splitName(a)
+	bl, _ := splitName(b)
+	n := 0
+	for n < len(al) && n < len(bl) && bytes.EqualFold(al[len(al)-1-n], bl[len(bl)-1-n]) {
+		n++
+	}
+	return joinLabels(al[len(al)-n:])
+}
+
+type nsecRecord struct {
+	owner  string
+	next   string
+	bitmap []byte
+}
+
+// covers reports whether the name falls strictly between the NSEC's owner
+// and next name, where the last NSEC in a zone wraps around to the apex.
+func (n *nsecRecord) covers(name string) bool {
+	if compareNames(n.owner, n.next) < 0 {
+		return compareNames(n.owner, name) < 0 && compareNames(name, n.next) < 0
+	}
+	return compareNames(n.owner, name) < 0 || compareNames(name, n.next) < 0
+}
+
+type nsec3Record struct {
+	hash       []byte
+	next       []byte
+	flags      uint8
+	iterations uint16
+	salt       []byte
+	bitmap     []byte
+}
+
+func (n *nsec3Record) covers(hash []byte) bool {
+	if bytes.Compare(n.hash, n.next) < 0 {
+		return bytes.Compare(n.hash, hash) < 0 && bytes.Compare(hash, n.next) < 0
+	}
+	return bytes.Compare(n.hash, hash) < 0 || bytes.Compare(hash, n.next) < 0
+}
+
+// nsec3Hash hashes a name the way NSEC3 owner names are (RFC 5155 section
+// 5).
+func nsec3Hash(name string, salt []byte, iterations uint16) []byte {
+	wire, err := nameWire(name)
+	if err != nil {
+		return nil
+	}
+	h := sha1.Sum(append(wire, salt...))
+	for i := 0; i < int(iterations); i++ {
+		h = sha1.Sum(append(h[:], salt...))
+	}
+	return h[:]
+}
+
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// denial holds the NSEC and NSEC3 records from a response whose signatures
+// checked out, for proving names or types don't exist.
+type denial struct {
+	zone  string
+	nsec  []*nsecRecord
+	nsec3 []*nsec3Record
+}
+
+func newDenial(records, keys []DNSResourceRecord, zone string, now time.Time) *denial {
+	d := &denial{zone: zone}
+	for _, rrset := range groupRRsets(records) {
+		rr := rrset[0]
+		if rr.TYPE != TypeNSEC && rr.TYPE != TypeNSEC3 {
+			continue
+		}
+		if !isSubdomain(rr.NAME, zone) {
+			continue
+		}
+		if _, err := verifyRRset(rrset, records, keys, zone, now); err != nil {
+			continue
+		}
+		if rr.TYPE == TypeNSEC {
+			next, p, err := unpackName(rr.RDATA, 0)
+			if err != nil {
+				continue
+			}
+			d.nsec = append(d.nsec, &nsecRecord{owner: canonicalName(rr.NAME), next: canonicalName(next), bitmap: rr.RDATA[p:]})
+			continue
+		}
+
+		rdata := rr.RDATA
+		if len(rdata) < 5 || rdata[0] != nsec3HashSHA1 {
+			continue
+		}
+		saltEnd := 5 + int(rdata[4])
+		if saltEnd >= len(rdata) || saltEnd+1+int(rdata[saltEnd]) > len(rdata) {
+			continue
+		}
+		hashEnd := saltEnd + 1 + int(rdata[saltEnd])
+		labels, err := splitName(rr.NAME)
+		if err != nil || len(labels) == 0 || canonicalName(joinLabels(labels[1:])) != zone {
+			continue
+		}
+		hash, err := base32Hex.DecodeString(strings.ToUpper(string(labels[0])))
+		if err != nil {
+			continue
+		}
+		n := &nsec3Record{
+			hash:       hash,
+			next:       rdata[saltEnd+1 : hashEnd],
+			flags:      rdata[1],
+			iterations: binary.BigEndian.Uint16(rdata[2:]),
+			salt:       rdata[5:saltEnd],
+			bitmap:     rdata[hashEnd:],
+		}
+		if n.iterations <= maxNSEC3Rounds {
+			d.nsec3 = append(d.nsec3, n)
+		}
+	}
+	return d
+}
+
+// noData proves the name exists but has no records of the type.
+func (d *denial) noData(name string, qtype uint16) error {
+	for _, n := range d.nsec {
+		if n.owner == name {
+			if typeBitmapHas(n.bitmap, qtype) || typeBitmapHas(n.bitmap, TypeCNAME) {
+				return bogus(EDEDNSSECBogus, "NSEC for %s says it has %s records", name, typeString(qtype))
+			}
+			return nil
+		}
+	}
+	for _, n := range d.nsec3 {
+		if bytes.Equal(n.hash, nsec3Hash(name, n.salt, n.iterations)) {
+			if typeBitmapHas(n.bitmap, qtype) || typeBitmapHas(n.bitmap, TypeCNAME) {
+				return bogus(EDEDNSSECBogus, "NSEC3 for %s says it has %s records", name, typeString(qtype))
+			}
+			return nil
+		}
+	}
+
+	// or the name came from a wildcard that doesn't have the type
+	for _, n := range d.nsec {
+		if n.covers(name) {
+			wildcard := "*." + d.closestEncloserNSEC(name)
+			for _, w := range d.nsec {
+				if w.owner == wildcard && !typeBitmapHas(w.bitmap, qtype) && !typeBitmapHas(w.bitmap, TypeCNAME) {
+					return nil
+				}
+			}
+		}
+	}
+	if encloser, err := d.closestEncloserNSEC3(name); err == nil {
+		if qtype == TypeDS && encloser.optOut {
+			return nil
+		}
+		wildcard := "*." + encloser.name
+		for _, n := range d.nsec3 {
+			if bytes.Equal(n.hash, nsec3Hash(wildcard, n.salt, n.iterations)) &&
+				!typeBitmapHas(n.bitmap, qtype) && !typeBitmapHas(n.bitmap, TypeCNAME) {
+				return nil
+			}
+		}
+	}
+	return bogus(EDENSECMissing, "no proof that %s has no %s records", name, typeString(qtype))
+}
+
+// nxDomain proves the name doesn't exist, and that no wildcard could have
+// made it.
+func (d *denial) nxDomain(name string) error {
+	for _, n := range d.nsec {
+		if !n.covers(name) {
+			continue
+		}
+		wildcard := "*." + d.closestEncloserNSEC(name)
+		for _, w := range d.nsec {
+			if w.covers(wildcard) {
+				return nil
+			}
+		}
+	}
+	if encloser, err := d.closestEncloserNSEC3(name); err == nil {
+		wildcard := "*." + encloser.name
+		for _, n := range d.nsec3 {
+			if n.covers(nsec3Hash(wildcard, n.salt, n.iterations)) {
+				return nil
+			}
+		}
+	}
+	return bogus(EDENSECMissing, "no proof that %s doesn't exist", name)
+}
+
+// noDS proves a delegation is unsigned: the child's name exists as a
+// delegation with no DS records, or NSEC3 opt-out covers it.
+func (d *denial) noDS(name string) error {
+	for _, n := range d.nsec {
+		if n.owner == name {
+			if !typeBitmapHas(n.bitmap, TypeNS) || typeBitmapHas(n.bitmap, TypeDS) || typeBitmapHas(n.bitmap, TypeSOA) {
+				return bogus(EDEDNSSECBogus, "NSEC for %s doesn't show an unsigned delegation", name)
+			}
+			return nil
+		}
+	}
+	for _, n := range d.nsec3 {
+		if bytes.Equal(n.hash, nsec3Hash(name, n.salt, n.iterations)) {
+			if !typeBitmapHas(n.bitmap, TypeNS) || typeBitmapHas(n.bitmap, TypeDS) || typeBitmapHas(n.bitmap, TypeSOA) {
+				return bogus(EDEDNSSECBogus, "NSEC3 for %s doesn't show an unsigned delegation", name)
+			}
+			return nil
+		}
+	}
+	if encloser, err := d.closestEncloserNSEC3(name); err == nil && encloser.optOut {
+		return nil
+	}
+	return bogus(EDENSECMissing, "no DS records for %s and no proof it's unsigned", name)
+}
+
+// wildcardAnswer proves that an answer synthesized from the wildcard at the
+// source of synthesis wasn't for a name that exists itself.
+func (d *denial) wildcardAnswer(name, source string) error {
+	for _, n := range d.nsec {
+		if n.covers(name) {
+			return nil
+		}
+	}
+	labels, _ := splitName(name)
+	sourceLabels, _ := splitName(source)
+	if len(labels) > len(sourceLabels) {
+		nextCloser := joinLabels(labels[len(labels)-len(sourceLabels)-1:])
+		for _, n := range d.nsec3 {
+			if n.covers(nsec3Hash(nextCloser, n.salt, n.iterations)) {
+				return nil
+			}
+		}
+	}
+	return bogus(EDENSECMissing, "no proof that %s doesn't exist apart from its wildcard", name)
+}
+
+// closestEncloserNSEC finds the closest encloser of a name from the NSEC that
+// covers it, the deepest ancestor shared with either end of the NSEC.
+func (d *denial) closestEncloserNSEC(name string) string {
+	best := d.zone
+	for _, n := range d.nsec {
+		if !n.covers(name) {
+			continue
+		}
+		for _, ancestor := range []string{commonAncestor(name, n.owner), commonAncestor(name, n.next)} {
+			if labelCount(ancestor) > labelCount(best) {
+				best = canonicalName(ancestor)
+			}
+		}
+	}
+	return best
+}
+
+type encloser struct {
+	name   string
+	optOut bool // whether the NSEC3 covering the next closer name has opt-out set
+}
+
+// closestEncloserNSEC3 does the closest encloser proof of RFC 5155 section
+// 8.3: an NSEC3 matching an ancestor of the name, and one covering the next
+// name down towards it.
+func (d *denial) closestEncloserNSEC3(name string) (*encloser, error) {
+	labels, err := splitName(name)
+	if err != nil {
+		return nil, err
+	}
+	zoneLabels := labelCount(d.zone)
+	for i := 1; len(labels)-i >= zoneLabels; i++ {
+		candidate := joinLabels(labels[i:])
+		nextCloser := joinLabels(labels[i-1:])
+		for _, match := range d.nsec3 {
+			if !bytes.Equal(match.hash, nsec3Hash(candidate, match.salt, match.iterations)) {
+				continue
+			}
+			for _, cover := range d.nsec3 {
+				if cover.covers(nsec3Hash(nextCloser, cover.salt, cover.iterations)) {
+					return &encloser{name: canonicalName(candidate), optOut: cover.flags&flagOptOut != 0}, nil
+				}
+			}
+			return nil, fmt.Errorf("no NSEC3 covers %s", nextCloser)
+		}
+	}
+	return nil, fmt.Errorf("no closest encloser for %s", name)
+}
+
+// groupRRsets splits records into RRsets by owner and type, in the order
+// they first appear. RRSIGs are left out, since they're checked along with
+// the RRsets they cover.
+func groupRRsets(records []DNSResourceRecord) [][]DNSResourceRecord {
+	var rrsets [][]DNSResourceRecord
+	index := make(map[string]int)
+	for _, rr := range records {
+		if rr.TYPE == TypeRRSIG {
+			continue
+		}
+		key := canonicalName(rr.NAME) + " " + strconv.Itoa(int(rr.TYPE))
+		i, ok := index[key]
+		if !ok {
+			i = len(rrsets)
+			index[key] = i
+			rrsets = append(rrsets, nil)
+		}
+		rrsets[i] = append(rrsets[i], rr)
+	}
+	return rrsets
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKey is a zone's signing key, for making signed records to validate.
+type testKey struct {
+	zone   string
+	alg    uint8
+	dnskey DNSResourceRecord
+	sign   func(data []byte) []byte
+}
+
+func newTestKey(t *testing.T, zone string, alg uint8) *testKey {
+	t.Helper()
+	k := &testKey{zone: zone, alg: alg}
+	var pubkey []byte
+	switch alg {
+	case AlgorithmED25519:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubkey = pub
+		k.sign = func(data []byte) []byte { return ed25519.Sign(priv, data) }
+	case AlgorithmECDSAP256SHA256:
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubkey = append(priv.X.FillBytes(make([]byte, 32)), priv.Y.FillBytes(make([]byte, 32))...)
+		k.sign = func(data []byte) []byte {
+			digest := sha256.Sum256(data)
+			r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	default:
+		t.Fatalf("can't make keys for algorithm %d", alg)
+	}
+	rdata := binary.BigEndian.AppendUint16(nil, flagZoneKey)
+	rdata = append(rdata, 3, alg)
+	k.dnskey = testRecord(t, zone, TypeDNSKEY, append(rdata, pubkey...))
+	return k
+}
+
+// signValid signs an RRset with signatures valid from an hour ago for a day.
+func (k *testKey) signValid(t *testing.T, rrset []DNSResourceRecord) DNSResourceRecord {
+	return k.signAt(t, rrset, time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour))
+}
+
+func (k *testKey) signAt(t *testing.T, rrset []DNSResourceRecord, inception, expiration time.Time) DNSResourceRecord {
+	t.Helper()
+	owner := canonicalName(rrset[0].NAME)
+	labels := labelCount(owner)
+	if strings.HasPrefix(owner, "*.") {
+		labels--
+	}
+	rdata := binary.BigEndian.AppendUint16(nil, rrset[0].TYPE)
+	rdata = append(rdata, k.alg, byte(labels))
+	rdata = binary.BigEndian.AppendUint32(rdata, rrset[0].TTL)
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(expiration.Unix()))
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(inception.Unix()))
+	rdata = binary.BigEndian.AppendUint16(rdata, keyTag(k.dnskey.RDATA))
+	signer, err := packName(k.zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := testRecord(t, owner, TypeRRSIG, append(rdata, signer...))
+	data, _, err := signedData(rrset, &sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testRecord(t, owner, TypeRRSIG, append(sig.RDATA, k.sign(data)...))
+}
+
+// testRecord builds a record from its RDATA.
+func testRecord(t *testing.T, name string, rrtype uint16, rdata []byte) DNSResourceRecord {
+	t.Helper()
+	_, s, err := unpackRDATA(rdata, 0, len(rdata), rrtype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return DNSResourceRecord{NAME: name, TYPE: rrtype, CLASS: ClassINET, TTL: 3600, RDATA: rdata, Data: s}
+}
+
+// testBitmap builds an NSEC type bitmap for types below 256.
+func testBitmap(types ...uint16) []byte {
+	bits := make([]byte, 32)
+	length := 0
+	for _, rrtype := range types {
+		bits[rrtype/8] |= 0x80 >> (rrtype % 8)
+		if int(rrtype/8)+1 > length {
+			length = int(rrtype/8) + 1
+		}
+	}
+	return append([]byte{0, byte(length)}, bits[:length]...)
+}
+
+func testNSEC(t *testing.T, owner, next string, types ...uint16) DNSResourceRecord {
+	t.Helper()
+	rdata, err := packName(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testRecord(t, owner, TypeNSEC, append(rdata, testBitmap(types...)...))
+}
+
+// testNSEC3Chain builds a complete NSEC3 chain for the names in a zone, with
+// no salt or extra iterations, each with the types given for it.
+func testNSEC3Chain(t *testing.T, zone string, flags uint8, names map[string][]uint16) []DNSResourceRecord {
+	t.Helper()
+	type entry struct {
+		hash  []byte
+		types []uint16
+	}
+	var entries []entry
+	for name, types := range names {
+		entries = append(entries, entry{nsec3Hash(name, nil, 0), types})
+	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].hash, entries[j].hash) < 0 })
+
+	var chain []DNSResourceRecord
+	for i, e := range entries {
+		next := entries[(i+1)%len(entries)].hash
+		rdata := []byte{nsec3HashSHA1, flags, 0, 0, 0, byte(len(next))}
+		rdata = append(rdata, next...)
+		rdata = append(rdata, testBitmap(e.types...)...)
+		owner := strings.ToLower(base32Hex.EncodeToString(e.hash)) + "." + zone
+		chain = append(chain, testRecord(t, owner, TypeNSEC3, rdata))
+	}
+	return chain
+}
+
+// signAll signs each of the RRsets in the records, and returns them with
+// their signatures.
+func (k *testKey) signAll(t *testing.T, records []DNSResourceRecord) []DNSResourceRecord {
+	signed := append([]DNSResourceRecord{}, records...)
+	for _, rrset := range groupRRsets(records) {
+		signed = append(signed, k.signValid(t, rrset))
+	}
+	return signed
+}
+
+func TestVerifyRRset(t *testing.T) {
+	ed := newTestKey(t, "example.", AlgorithmED25519)
+	ec := newTestKey(t, "example.", AlgorithmECDSAP256SHA256)
+	other := newTestKey(t, "other.", AlgorithmED25519)
+	rrset := []DNSResourceRecord{
+		testRR(t, "www.example.", TypeA, "192.0.2.1"),
+		testRR(t, "www.example.", TypeA, "192.0.2.2"),
+	}
+	tampered := []DNSResourceRecord{rrset[0], testRR(t, "www.example.", TypeA, "192.0.2.3")}
+	upper := []DNSResourceRecord{rrset[1], rrset[0]}
+	for i := range upper {
+		upper[i].NAME = "WWW.Example."
+	}
+	expanded := []DNSResourceRecord{testRR(t, "*.example.", TypeA, "192.0.2.1")}
+	wildcardSig := ed.signValid(t, expanded)
+	wildcardSig.NAME = "anything.example."
+	expanded[0].NAME = "anything.example."
+
+	revoked := *ed
+	revoked.dnskey.RDATA = append([]byte{}, ed.dnskey.RDATA...)
+	revoked.dnskey.RDATA[1] |= flagRevoked
+	revokedSig := revoked.signValid(t, rrset)
+
+	now := time.Now()
+	tests := []struct {
+		name  string
+		rrset []DNSResourceRecord
+		sigs  []DNSResourceRecord
+		keys  []DNSResourceRecord
+		code  uint16 // the EDE code of the error, or 0 for none
+	}{
+		{"ed25519", rrset, []DNSResourceRecord{ed.signValid(t, rrset)}, []DNSResourceRecord{ed.dnskey}, 0},
+		{"ecdsa", rrset, []DNSResourceRecord{ec.signValid(t, rrset)}, []DNSResourceRecord{ed.dnskey, ec.dnskey}, 0},
+		{"case and order", upper, []DNSResourceRecord{ed.signValid(t, rrset)}, []DNSResourceRecord{ed.dnskey}, 0},
+		{"wildcard", expanded, []DNSResourceRecord{wildcardSig}, []DNSResourceRecord{ed.dnskey}, 0},
+		{"tampered", tampered, []DNSResourceRecord{ed.signValid(t, rrset)}, []DNSResourceRecord{ed.dnskey}, EDEDNSSECBogus},
+		{"wrong key", rrset, []DNSResourceRecord{ec.signValid(t, rrset)}, []DNSResourceRecord{ed.dnskey}, EDERRSIGsMissing},
+		{"wrong signer", rrset, []DNSResourceRecord{other.signValid(t, rrset)}, []DNSResourceRecord{other.dnskey}, EDERRSIGsMissing},
+		{"unsigned", rrset, nil, []DNSResourceRecord{ed.dnskey}, EDERRSIGsMissing},
+		{"revoked", rrset, []DNSResourceRecord{revokedSig}, []DNSResourceRecord{revoked.dnskey}, EDEDNSSECBogus},
+		{"expired", rrset, []DNSResourceRecord{ed.signAt(t, rrset, now.Add(-48*time.Hour), now.Add(-time.Hour))}, []DNSResourceRecord{ed.dnskey}, EDESignatureExpired},
+		{"not yet valid", rrset, []DNSResourceRecord{ed.signAt(t, rrset, now.Add(time.Hour), now.Add(48*time.Hour))}, []DNSResourceRecord{ed.dnskey}, EDESignatureNotYetValid},
+	}
+	for _, tt := range tests {
+		_, err := verifyRRset(tt.rrset, tt.sigs, tt.keys, "example.", now)
+		if tt.code == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		var invalid *validationError
+		if !errors.As(err, &invalid) || invalid.code != tt.code || !errors.Is(err, errBogus) {
+			t.Errorf("%s: got %v, want EDE %d", tt.name, err, tt.code)
+		}
+	}
+}
+
+func TestSignedDataCanonical(t *testing.T) {
+	sig := testRecord(t, "example.", TypeRRSIG, append([]byte{0, 2, 15, 1, 0, 0, 14, 16, 0, 0, 0, 2, 0, 0, 0, 1, 0, 1}, 7, 'E', 'x', 'a', 'm', 'p', 'l', 'e', 0))
+	a := testRR(t, "example.", TypeNS, "ns2.example.")
+	b := testRR(t, "example.", TypeNS, "NS1.Example.")
+	want, _, err := signedData([]DNSResourceRecord{a, b}, &sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the order, case of the owner and names in RDATA, and duplicates
+	// don't change what gets signed
+	b.NAME = "EXAMPLE."
+	got, _, err := signedData([]DNSResourceRecord{b, a, b}, &sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got\n% x\nwant\n% x", got, want)
+	}
+
+	var expected []byte
+	expected = append(expected, sig.RDATA[:18]...)
+	expected = append(expected, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0)
+	for _, ns := range []string{"ns1", "ns2"} {
+		rdata := append([]byte{3}, ns...)
+		rdata = append(rdata, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0)
+		expected = append(expected, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0)
+		expected = append(expected, 0, 2, 0, 1, 0, 0, 14, 16, 0, byte(len(rdata)))
+		expected = append(expected, rdata...)
+	}
+	if !bytes.Equal(want, expected) {
+		t.Errorf("got\n% x\nwant\n% x", want, expected)
+	}
+}
+
+func TestDenialNSEC(t *testing.T) {
+	key := newTestKey(t, "example.", AlgorithmED25519)
+	keys := []DNSResourceRecord{key.dnskey}
+	apex := testNSEC(t, "example.", "a.example.", TypeSOA, TypeNS, TypeNSEC, TypeRRSIG, TypeDNSKEY)
+	a := testNSEC(t, "a.example.", "insecure.example.", TypeA, TypeNSEC, TypeRRSIG)
+	insecure := testNSEC(t, "insecure.example.", "secure.example.", TypeNS, TypeNSEC, TypeRRSIG)
+	secure := testNSEC(t, "secure.example.", "example.", TypeNS, TypeDS, TypeNSEC, TypeRRSIG)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		records []DNSResourceRecord
+		check   func(d *denial) error
+		ok      bool
+	}{
+		{"nxdomain", []DNSResourceRecord{apex, a}, func(d *denial) error { return d.nxDomain("b.example.") }, true},
+		{"nxdomain without wildcard proof", []DNSResourceRecord{a}, func(d *denial) error { return d.nxDomain("b.example.") }, false},
+		{"nxdomain for a name that exists", []DNSResourceRecord{apex, a}, func(d *denial) error { return d.nxDomain("a.example.") }, false},
+		{"nodata", []DNSResourceRecord{a}, func(d *denial) error { return d.noData("a.example.", TypeAAAA) }, true},
+		{"nodata for a type that exists", []DNSResourceRecord{a}, func(d *denial) error { return d.noData("a.example.", TypeA) }, false},
+		{"nodata without a matching nsec", []DNSResourceRecord{apex}, func(d *denial) error { return d.noData("a.example.", TypeAAAA) }, false},
+		{"no ds", []DNSResourceRecord{insecure}, func(d *denial) error { return d.noDS("insecure.example.") }, true},
+		{"no ds with ds", []DNSResourceRecord{secure}, func(d *denial) error { return d.noDS("secure.example.") }, false},
+		{"no ds at an apex", []DNSResourceRecord{apex}, func(d *denial) error { return d.noDS("example.") }, false},
+		{"no ds for a name that isn't a delegation", []DNSResourceRecord{a}, func(d *denial) error { return d.noDS("a.example.") }, false},
+	}
+	for _, tt := range tests {
+		d := newDenial(key.signAll(t, tt.records), keys, "example.", now)
+		if err := tt.check(d); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+
+	// records whose signatures don't check out prove nothing
+	d := newDenial([]DNSResourceRecord{apex, a}, keys, "example.", now)
+	if err := d.nxDomain("b.example."); err == nil {
+		t.Error("unsigned NSEC records proved a name doesn't exist")
+	}
+}
+
+func TestDenialNSEC3(t *testing.T) {
+	key := newTestKey(t, "example.", AlgorithmED25519)
+	keys := []DNSResourceRecord{key.dnskey}
+	names := map[string][]uint16{
+		"example.":          {TypeSOA, TypeNS, TypeDNSKEY, TypeRRSIG},
+		"a.example.":        {TypeA, TypeRRSIG},
+		"insecure.example.": {TypeNS},
+	}
+	chain := testNSEC3Chain(t, "example.", 0, names)
+	optOut := testNSEC3Chain(t, "example.", flagOptOut, map[string][]uint16{"example.": names["example."], "a.example.": names["a.example."]})
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		records []DNSResourceRecord
+		check   func(d *denial) error
+		ok      bool
+	}{
+		{"nxdomain", chain, func(d *denial) error { return d.nxDomain("b.example.") }, true},
+		{"nxdomain below a missing name", chain, func(d *denial) error { return d.nxDomain("x.b.example.") }, true},
+		{"nxdomain for a name that exists", chain, func(d *denial) error { return d.nxDomain("a.example.") }, false},
+		{"nodata", chain, func(d *denial) error { return d.noData("a.example.", TypeAAAA) }, true},
+		{"nodata for a type that exists", chain, func(d *denial) error { return d.noData("a.example.", TypeA) }, false},
+		{"no ds", chain, func(d *denial) error { return d.noDS("insecure.example.") }, true},
+		{"no ds for a name that isn't a delegation", chain, func(d *denial) error { return d.noDS("a.example.") }, false},
+		{"no ds under opt-out", optOut, func(d *denial) error { return d.noDS("insecure.example.") }, true},
+		{"no ds without opt-out", chain, func(d *denial) error { return d.noDS("missing.example.") }, false},
+	}
+	for _, tt := range tests {
+		d := newDenial(key.signAll(t, tt.records), keys, "example.", now)
+		if err := tt.check(d); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
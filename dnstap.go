@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// dnstap files are Frame Streams: data frames are prefixed with their length,
+// and control frames are a zero length followed by the control frame's
+// length.
+const (
+	fstrmControlStart = 0x02
+	fstrmControlStop  = 0x03
+
+	fstrmFieldContentType = 0x01
+
+	dnstapContentType = "protobuf:dnstap.Dnstap"
+
+	// large enough for any DNS message and its metadata
+	fstrmMaxFrameLength = 1 << 20
+)
+
+var dnstapMessageTypes = map[uint64]string{
+	1:  "AQ",
+	2:  "AR",
+	3:  "RQ",
+	4:  "RR",
+	5:  "CQ",
+	6:  "CR",
+	7:  "FQ",
+	8:  "FR",
+	9:  "SQ",
+	10: "SR",
+	11: "TQ",
+	12: "TR",
+	13: "UQ",
+	14: "UR",
+}
+
+var dnstapProtocols = map[uint64]string{
+	1: "UDP",
+	2: "TCP",
+	3: "DOT",
+	4: "DOH",
+	5: "DNSCryptUDP",
+	6: "DNSCryptTCP",
+	7: "DOQ",
+}
+
+// dnstapMessage holds the fields of a dnstap Message we know how to show.
+type dnstapMessage struct {
+	Identity        string
+	Type            uint64
+	Protocol        uint64
+	QueryAddress    net.IP
+	QueryPort       uint64
+	ResponseAddress net.IP
+	ResponsePort    uint64
+	QueryTime       time.Time
+	ResponseTime    time.Time
+	QueryMessage    []byte
+	ResponseMessage []byte
+}
+
+func dnstapMain(args []string) error {
+	if len(args) == 0 || args[0] != "read" {
+		fmt.Fprintln(os.Stderr, "usage: dunce dnstap read [flags] file")
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet("dnstap read", flag.ExitOnError)
+	verbose := flags.Bool("v", false, "print the full decoded DNS messages")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dunce dnstap read [flags] file")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args[1:])
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("unable to open dnstap file: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if err := readFstrmStart(r); err != nil {
+		return err
+	}
+	for {
+		frame, err := readFstrmFrame(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		msg, err := unpackDnstap(frame)
+		if err != nil {
+			return err
+		}
+		if msg != nil {
+			printDnstap(os.Stdout, msg, *verbose)
+		}
+	}
+}
+
+func readFstrmStart(r io.Reader) error {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return fmt.Errorf("unable to read frame streams header: %w", err)
+	}
+	if binary.BigEndian.Uint32(header[0:]) != 0 {
+		return errors.New("file doesn't start with a frame streams control frame")
+	}
+	n := binary.BigEndian.Uint32(header[4:])
+	if n < 4 || n > fstrmMaxFrameLength {
+		return errors.New("frame streams start frame has a bad length")
+	}
+	control := make([]byte, n)
+	if _, err := io.ReadFull(r, control); err != nil {
+		return fmt.Errorf("unable to read frame streams start frame: %w", err)
+	}
+	if binary.BigEndian.Uint32(control) != fstrmControlStart {
+		return errors.New("file doesn't start with a frame streams start frame")
+	}
+
+	// a start frame with no content type is a wildcard, otherwise one of
+	// them has to be dnstap
+	fields := control[4:]
+	if len(fields) == 0 {
+		return nil
+	}
+	for len(fields) >= 8 {
+		fieldType := binary.BigEndian.Uint32(fields[0:])
+		length := int(binary.BigEndian.Uint32(fields[4:]))
+		if 8+length > len(fields) {
+			break
+		}
+		if fieldType == fstrmFieldContentType && string(fields[8:8+length]) == dnstapContentType {
+			return nil
+		}
+		fields = fields[8+length:]
+	}
+	return fmt.Errorf("frame streams content type isn't %s", dnstapContentType)
+}
+
+// readFstrmFrame returns the next data frame, or io.EOF at the stop frame or
+// the end of the file.
+func readFstrmFrame(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errors.New("dnstap file is truncated")
+		}
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n == 0 {
+		// a control frame, and the only one we expect after start is stop
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, errors.New("dnstap file is truncated")
+		}
+		n := binary.BigEndian.Uint32(length[:])
+		if n < 4 || n > fstrmMaxFrameLength {
+			return nil, errors.New("frame streams control frame has a bad length")
+		}
+		control := make([]byte, n)
+		if _, err := io.ReadFull(r, control); err != nil {
+			return nil, errors.New("dnstap file is truncated")
+		}
+		if binary.BigEndian.Uint32(control) == fstrmControlStop {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("unexpected frame streams control frame type %d", binary.BigEndian.Uint32(control))
+	}
+	if n > fstrmMaxFrameLength {
+		return nil, fmt.Errorf("frame of %d bytes is too large", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, errors.New("dnstap file is truncated")
+	}
+	return frame, nil
+}
+
+// protobufFields walks the fields of an encoded protobuf message, calling fn
+// with each field number, wire type, and value. Varints and fixed width
+// values come as num, length delimited values as buf.
+func protobufFields(buf []byte, fn func(field int, wireType int, num uint64, value []byte) error) error {
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errors.New("bad protobuf field key")
+		}
+		buf = buf[n:]
+		field, wireType := int(key>>3), int(key&0x7)
+
+		var num uint64
+		var value []byte
+		switch wireType {
+		case 0: // varint
+			num, n = binary.Uvarint(buf)
+			if n <= 0 {
+				return errors.New("bad protobuf varint")
+			}
+			buf = buf[n:]
+		case 1: // 64 bit
+			if len(buf) < 8 {
+				return errors.New("protobuf message is truncated")
+			}
+			num = binary.LittleEndian.Uint64(buf)
+			buf = buf[8:]
+		case 2: // length delimited
+			length, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < length {
+				return errors.New("protobuf message is truncated")
+			}
+			value = buf[n : n+int(length)]
+			buf = buf[n+int(length):]
+		case 5: // 32 bit
+			if len(buf) < 4 {
+				return errors.New("protobuf message is truncated")
+			}
+			num = uint64(binary.LittleEndian.Uint32(buf))
+			buf = buf[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", wireType)
+		}
+		if err := fn(field, wireType, num, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unpackDnstap decodes a Dnstap protobuf, returning nil for the kinds of
+// payload that aren't messages.
+func unpackDnstap(frame []byte) (*dnstapMessage, error) {
+	var identity string
+	var message []byte
+	err := protobufFields(frame, func(field, wireType int, num uint64, value []byte) error {
+		switch field {
+		case 1:
+			identity = string(value)
+		case 14:
+			message = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode dnstap frame: %w", err)
+	}
+	if message == nil {
+		return nil, nil
+	}
+
+	msg := &dnstapMessage{Identity: identity}
+	var querySec, queryNsec, responseSec, responseNsec uint64
+	err = protobufFields(message, func(field, wireType int, num uint64, value []byte) error {
+		switch field {
+		case 1:
+			msg.Type = num
+		case 3:
+			msg.Protocol = num
+		case 4:
+			msg.QueryAddress = net.IP(value)
+		case 5:
+			msg.ResponseAddress = net.IP(value)
+		case 6:
+			msg.QueryPort = num
+		case 7:
+			msg.ResponsePort = num
+		case 8:
+			querySec = num
+		case 9:
+			queryNsec = num
+		case 10:
+			msg.QueryMessage = value
+		case 12:
+			responseSec = num
+		case 13:
+			responseNsec = num
+		case 14:
+			msg.ResponseMessage = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode dnstap message: %w", err)
+	}
+	if querySec != 0 {
+		msg.QueryTime = time.Unix(int64(querySec), int64(queryNsec))
+	}
+	if responseSec != 0 {
+		msg.ResponseTime = time.Unix(int64(responseSec), int64(responseNsec))
+	}
+	return msg, nil
+}
+
+func printDnstap(out io.Writer, msg *dnstapMessage, verbose bool) {
+	// queries are stamped with the query time, and responses with the
+	// response time
+	isResponse := msg.Type%2 == 0
+	stamp, packed := msg.QueryTime, msg.QueryMessage
+	if isResponse {
+		stamp, packed = msg.ResponseTime, msg.ResponseMessage
+	}
+
+	kind, ok := dnstapMessageTypes[msg.Type]
+	if !ok {
+		kind = "T" + strconv.FormatUint(msg.Type, 10)
+	}
+	protocol, ok := dnstapProtocols[msg.Protocol]
+	if !ok {
+		protocol = "?"
+	}
+	arrow := "->"
+	if isResponse {
+		arrow = "<-"
+	}
+	when := "-"
+	if !stamp.IsZero() {
+		when = stamp.UTC().Format("2006-01-02 15:04:05.000000")
+	}
+
+	summary := "no message"
+	var decoded *DNSMessage
+	if packed != nil {
+		decoded = &DNSMessage{}
+		if err := decoded.Unpack(packed); err != nil {
+			summary = fmt.Sprintf("bad message: %v", err)
+			decoded = nil
+		} else {
+			summary = dnstapSummary(decoded, isResponse)
+		}
+	}
+
+	fmt.Fprintf(out, "%s %s %s %s %s %s %s\n", when, kind,
+		dnstapAddress(msg.QueryAddress, msg.QueryPort), arrow,
+		dnstapAddress(msg.ResponseAddress, msg.ResponsePort), protocol, summary)
+	if verbose && msg.Identity != "" {
+		fmt.Fprintf(out, ";; identity: %s\n", msg.Identity)
+	}
+	if verbose && decoded != nil {
+		fmt.Fprintln(out, decoded.String())
+	}
+}
+
+func dnstapAddress(ip net.IP, port uint64) string {
+	if ip == nil {
+		return "-"
+	}
+	return net.JoinHostPort(ip.String(), strconv.FormatUint(port, 10))
+}
+
+func dnstapSummary(msg *DNSMessage, isResponse bool) string {
+	question := "?"
+	if len(msg.Questions) > 0 {
+		q := msg.Questions[0]
+		question = fmt.Sprintf("%s %s %s", q.QNAME, classString(q.QCLASS), typeString(q.QTYPE))
+	}
+	if !isResponse {
+		return question
+	}
+	return fmt.Sprintf("%s %s %d answers", question, rcodeString(msg.Rcode()), len(msg.Answers))
+}
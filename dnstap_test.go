@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pbVarint and the rest encode protobuf fields, for building dnstap frames.
+func pbVarint(field int, v uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, uint64(field)<<3), v)
+}
+
+func pbFixed32(field int, v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(binary.AppendUvarint(nil, uint64(field)<<3|5), v)
+}
+
+func pbBytes(field int, b []byte) []byte {
+	buf := binary.AppendUvarint(nil, uint64(field)<<3|2)
+	return append(binary.AppendUvarint(buf, uint64(len(b))), b...)
+}
+
+// fstrmControl builds a control frame, with a content type field unless
+// contentType is empty.
+func fstrmControl(kind uint32, contentType string) []byte {
+	control := binary.BigEndian.AppendUint32(nil, kind)
+	if contentType != "" {
+		control = binary.BigEndian.AppendUint32(control, fstrmFieldContentType)
+		control = binary.BigEndian.AppendUint32(control, uint32(len(contentType)))
+		control = append(control, contentType...)
+	}
+	buf := binary.BigEndian.AppendUint32(nil, 0)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(control)))
+	return append(buf, control...)
+}
+
+func fstrmData(frame []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(frame))), frame...)
+}
+
+// testDnstapStream is a dnstap file with a client query and its response,
+// and a frame with no message between them.
+func testDnstapStream(t *testing.T) []byte {
+	query := &DNSMessage{
+		Header:    DNSHeader{ID: 1, RD: 1, QDCOUNT: 1},
+		Questions: []DNSQuestion{{QNAME: "www.example.", QTYPE: TypeA, QCLASS: ClassINET}},
+	}
+	packedQuery, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &DNSMessage{
+		Header:    DNSHeader{ID: 1, QR: 1, RD: 1, RA: 1, QDCOUNT: 1, ANCOUNT: 1},
+		Questions: query.Questions,
+		Answers:   []DNSResourceRecord{testRR(t, "www.example.", TypeA, "192.0.2.1")},
+	}
+	packedResp, err := resp.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket := bytes.Join([][]byte{
+		pbVarint(2, 1), // INET
+		pbVarint(3, 1), // UDP
+		pbBytes(4, net.IPv4(192, 0, 2, 10).To4()),
+		pbBytes(5, net.IPv4(192, 0, 2, 53).To4()),
+		pbVarint(6, 53000),
+		pbVarint(7, 53),
+	}, nil)
+	clientQuery := bytes.Join([][]byte{
+		pbVarint(1, 5),
+		socket,
+		pbVarint(8, 1700000000),
+		pbFixed32(9, 123456000),
+		pbBytes(10, packedQuery),
+	}, nil)
+	clientResponse := bytes.Join([][]byte{
+		pbVarint(1, 6),
+		socket,
+		pbVarint(12, 1700000000),
+		pbFixed32(13, 125000000),
+		pbBytes(14, packedResp),
+	}, nil)
+	dnstap := func(message []byte) []byte {
+		return bytes.Join([][]byte{pbBytes(1, []byte("ns1")), pbVarint(15, 1), pbBytes(14, message)}, nil)
+	}
+
+	return bytes.Join([][]byte{
+		fstrmControl(fstrmControlStart, dnstapContentType),
+		fstrmData(dnstap(clientQuery)),
+		fstrmData(pbBytes(1, []byte("ns1"))),
+		fstrmData(dnstap(clientResponse)),
+		fstrmControl(fstrmControlStop, ""),
+	}, nil)
+}
+
+func TestDnstapRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.dnstap")
+	if err := os.WriteFile(path, testDnstapStream(t), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	out := captureStdout(t, func() {
+		err = dnstapMain([]string{"read", path})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2023-11-14 22:13:20.123456 CQ 192.0.2.10:53000 -> 192.0.2.53:53 UDP www.example. IN A\n" +
+		"2023-11-14 22:13:20.125000 CR 192.0.2.10:53000 <- 192.0.2.53:53 UDP www.example. IN A NOERROR 1 answers\n"
+	if out != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestDnstapReadErrors(t *testing.T) {
+	stream := testDnstapStream(t)
+	start := fstrmControl(fstrmControlStart, dnstapContentType)
+	// afterStart is the start frame followed by buf
+	afterStart := func(buf ...byte) []byte {
+		return append(append([]byte{}, start...), buf...)
+	}
+	tests := []struct {
+		name   string
+		stream []byte
+		err    string // a part of the error
+	}{
+		{"empty", nil, "unable to read frame streams header"},
+		{"no start frame", stream[len(start):], "doesn't start with a frame streams control frame"},
+		{"stop first", fstrmControl(fstrmControlStop, ""), "doesn't start with a frame streams start frame"},
+		{"wrong content type", fstrmControl(fstrmControlStart, "protobuf:other.Other"), "content type isn't"},
+		{"short start frame", []byte{0, 0, 0, 0, 0, 0, 0, 2, 0, 0}, "start frame has a bad length"},
+		{"huge start frame", []byte{0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}, "start frame has a bad length"},
+		{"truncated start frame", start[:len(start)-1], "unable to read frame streams start frame"},
+		{"truncated frame", stream[:len(start)+10], "truncated"},
+		{"truncated length", afterStart(0, 0), "truncated"},
+		{"huge frame", afterStart(0xff, 0xff, 0xff, 0xff), "too large"},
+		{"short control frame", afterStart(0, 0, 0, 0, 0, 0, 0, 2, 0, 0), "control frame has a bad length"},
+		{"huge control frame", afterStart(0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff), "control frame has a bad length"},
+		{"second start", afterStart(start...), "unexpected frame streams control frame type 2"},
+		{"bad key", afterStart(fstrmData(bytes.Repeat([]byte{0xff}, 11))...), "bad protobuf field key"},
+		{"varint overflow", afterStart(fstrmData(append([]byte{0x08}, bytes.Repeat([]byte{0xff}, 10)...))...), "bad protobuf varint"},
+		{"bad field length", afterStart(fstrmData([]byte{0x0a, 0x05, 'a'})...), "truncated"},
+		{"bad message", afterStart(fstrmData(pbBytes(14, []byte{0x0d, 1}))...), "unable to decode dnstap message"},
+		{"unknown wire type", afterStart(fstrmData([]byte{0x0b})...), "unsupported protobuf wire type 3"},
+	}
+	for _, tt := range tests {
+		err := readDnstap(tt.stream)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want an error about %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// readDnstap decodes every frame of a stream the way dnstap read does,
+// without printing them.
+func readDnstap(stream []byte) error {
+	r := bytes.NewReader(stream)
+	if err := readFstrmStart(r); err != nil {
+		return err
+	}
+	for {
+		frame, err := readFstrmFrame(r)
+		if err != nil {
+			return err
+		}
+		if _, err := unpackDnstap(frame); err != nil {
+			return err
+		}
+	}
+}
+
+func TestUnpackDnstap(t *testing.T) {
+	frame := bytes.Join([][]byte{
+		pbBytes(1, []byte("ns1")),
+		pbVarint(15, 1),
+		// fields we don't know get skipped, whatever their wire type
+		pbBytes(2, []byte("1.0")),
+		{0x99, 0x01, 1, 2, 3, 4, 5, 6, 7, 8}, // field 19, 64 bit
+		pbBytes(14, bytes.Join([][]byte{pbVarint(1, 5), pbVarint(3, 2), pbFixed32(20, 0)}, nil)),
+	}, nil)
+	msg, err := unpackDnstap(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg == nil || msg.Identity != "ns1" || msg.Type != 5 || msg.Protocol != 2 || msg.QueryAddress != nil || !msg.QueryTime.IsZero() {
+		t.Errorf("got %+v", msg)
+	}
+
+	// the frame from a "dnstap read" of something that isn't a message
+	if msg, err := unpackDnstap(pbBytes(1, []byte("ns1"))); err != nil || msg != nil {
+		t.Errorf("got %+v, %v for a frame without a message", msg, err)
+	}
+}
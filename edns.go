@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// DefaultUDPSize is the EDNS buffer size from DNS flag day 2020, which avoids
+// fragmentation on nearly every path.
+const DefaultUDPSize = 1232
+
+const RcodeBadVersion uint16 = 16
+
+// QueryOptions control how queries get built.
+type QueryOptions struct {
+	NoRecursion bool
+	EDNS        bool
+	EDNSVersion uint8
+	UDPSize     uint16 // DefaultUDPSize if zero
+	DNSSECOK    bool
+	NSID        bool // ask the server to identify itself (RFC 5001)
+
+	// EDNSFallback asks again without EDNS when a server rejects it
+	EDNSFallback bool
+}
+
+// opt builds the OPT pseudo-record for a query. The class carries the udp
+// buffer size, and the ttl carries the extended rcode, version and flags.
+func (o QueryOptions) opt() DNSResourceRecord {
+	size := o.UDPSize
+	if size == 0 {
+		size = DefaultUDPSize
+	}
+	ttl := uint32(o.EDNSVersion) << 16
+	if o.DNSSECOK {
+		ttl |= 1 << 15
+	}
+	rdata := []byte{}
+	if o.NSID {
+		// the request is the option with nothing in it
+		rdata = appendEDNSOption(rdata, OptionNSID, nil)
+	}
+	return DNSResourceRecord{
+		NAME:  ".",
+		TYPE:  TypeOPT,
+		CLASS: size,
+		TTL:   ttl,
+		RDATA: rdata,
+	}
+}
+
+// OPT returns the message's OPT pseudo-record, or nil if it doesn't have one.
+func (m *DNSMessage) OPT() *DNSResourceRecord {
+	for i := range m.Additionals {
+		if m.Additionals[i].TYPE == TypeOPT {
+			return &m.Additionals[i]
+		}
+	}
+	return nil
+}
+
+// Rcode returns the full rcode, including the upper bits an OPT record adds.
+func (m *DNSMessage) Rcode() uint16 {
+	rcode := m.Header.RCODE
+	if opt := m.OPT(); opt != nil {
+		rcode |= uint16(opt.TTL>>24) << 4
+	}
+	return rcode
+}
+
+func ednsVersion(opt *DNSResourceRecord) uint8 {
+	return uint8(opt.TTL >> 16)
+}
+
+// EDNS option codes.
+const (
+	OptionNSID uint16 = 3  // name server identifier (RFC 5001)
+	OptionEDE  uint16 = 15 // Extended DNS Errors (RFC 8914)
+)
+
+// Extended DNS Error info codes we send.
+const (
+	EDEOther                uint16 = 0
+	EDEDNSSECBogus          uint16 = 6
+	EDESignatureExpired     uint16 = 7
+	EDESignatureNotYetValid uint16 = 8
+	EDEDNSKEYMissing        uint16 = 9
+	EDERRSIGsMissing        uint16 = 10
+	EDENSECMissing          uint16 = 12
+	EDEProhibited           uint16 = 18
+	EDENotAuthoritative     uint16 = 20
+	EDENotSupported         uint16 = 21
+	EDENoReachableAuthority uint16 = 22
+)
+
+var edeNames = map[uint16]string{
+	0:  "Other",
+	1:  "Unsupported DNSKEY Algorithm",
+	2:  "Unsupported DS Digest Type",
+	3:  "Stale Answer",
+	4:  "Forged Answer",
+	5:  "DNSSEC Indeterminate",
+	6:  "DNSSEC Bogus",
+	7:  "Signature Expired",
+	8:  "Signature Not Yet Valid",
+	9:  "DNSKEY Missing",
+	10: "RRSIGs Missing",
+	11: "No Zone Key Bit Set",
+	12: "NSEC Missing",
+	13: "Cached Error",
+	14: "Not Ready",
+	15: "Blocked",
+	16: "Censored",
+	17: "Filtered",
+	18: "Prohibited",
+	19: "Stale NXDOMAIN Answer",
+	20: "Not Authoritative",
+	21: "Not Supported",
+	22: "No Reachable Authority",
+	23: "Network Error",
+	24: "Invalid Data",
+	25: "Signature Expired before Valid",
+	26: "Too Early",
+	27: "Unsupported NSEC3 Iterations Value",
+}
+
+// ExtendedError is an Extended DNS Error option: an info code saying why a
+// response is what it is, and optionally some text for a human.
+type ExtendedError struct {
+	InfoCode  uint16
+	ExtraText string
+}
+
+func (e ExtendedError) String() string {
+	name, ok := edeNames[e.InfoCode]
+	if !ok {
+		name = "Unknown"
+	}
+	s := fmt.Sprintf("%d (%s)", e.InfoCode, name)
+	if e.ExtraText != "" {
+		s += ": " + e.ExtraText
+	}
+	return s
+}
+
+// ednsOptions calls fn with the code and data of each option in an OPT
+// record, stopping at the first one that doesn't fit.
+func ednsOptions(opt *DNSResourceRecord, fn func(code uint16, data []byte)) {
+	rdata := opt.RDATA
+	for len(rdata) >= 4 {
+		code, length := binary.BigEndian.Uint16(rdata), int(binary.BigEndian.Uint16(rdata[2:]))
+		if 4+length > len(rdata) {
+			return
+		}
+		fn(code, rdata[4:4+length])
+		rdata = rdata[4+length:]
+	}
+}
+
+func appendEDNSOption(rdata []byte, code uint16, data []byte) []byte {
+	rdata = binary.BigEndian.AppendUint16(rdata, code)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(data)))
+	return append(rdata, data...)
+}
+
+// ExtendedErrors returns the Extended DNS Errors in the message's OPT record.
+func (m *DNSMessage) ExtendedErrors() []ExtendedError {
+	opt := m.OPT()
+	if opt == nil {
+		return nil
+	}
+	var errs []ExtendedError
+	ednsOptions(opt, func(code uint16, data []byte) {
+		if code != OptionEDE || len(data) < 2 {
+			return
+		}
+		// the text should be utf-8 without a nul, but some servers send one
+		text := strings.TrimRight(string(data[2:]), "\x00")
+		errs = append(errs, ExtendedError{InfoCode: binary.BigEndian.Uint16(data), ExtraText: text})
+	})
+	return errs
+}
+
+func appendEDE(rdata []byte, e ExtendedError) []byte {
+	data := binary.BigEndian.AppendUint16(nil, e.InfoCode)
+	return appendEDNSOption(rdata, OptionEDE, append(data, e.ExtraText...))
+}
+
+// NSID returns the name server identifier in the message's OPT record, and
+// whether it had one.
+func (m *DNSMessage) NSID() ([]byte, bool) {
+	opt := m.OPT()
+	if opt == nil {
+		return nil, false
+	}
+	var nsid []byte
+	found := false
+	ednsOptions(opt, func(code uint16, data []byte) {
+		if code == OptionNSID && !found {
+			nsid, found = data, true
+		}
+	})
+	return nsid, found
+}
+
+// nsidString formats an NSID the way dig does, as hex and then as ascii
+// with anything unprintable as a dot, since it's opaque bytes that are
+// usually but not always a hostname.
+func nsidString(nsid []byte) string {
+	printable := make([]byte, len(nsid))
+	for i, b := range nsid {
+		printable[i] = b
+		if b < 0x20 || b > 0x7e {
+			printable[i] = '.'
+		}
+	}
+	return fmt.Sprintf("% x (\"%s\")", nsid, printable)
+}
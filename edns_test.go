@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// withOPT returns a message with an OPT record holding the options.
+func withOPT(rdata []byte) *DNSMessage {
+	return &DNSMessage{
+		Header:      DNSHeader{QR: 1},
+		Additionals: []DNSResourceRecord{{NAME: ".", TYPE: TypeOPT, CLASS: DefaultUDPSize, RDATA: rdata}},
+	}
+}
+
+func TestExtendedErrors(t *testing.T) {
+	ede := func(code uint16, text string) []byte {
+		return appendEDE(nil, ExtendedError{InfoCode: code, ExtraText: text})
+	}
+	join := func(options ...[]byte) []byte {
+		var rdata []byte
+		for _, option := range options {
+			rdata = append(rdata, option...)
+		}
+		return rdata
+	}
+	tests := []struct {
+		name  string
+		rdata []byte
+		want  []string
+	}{
+		{"none", nil, nil},
+		{"one", ede(EDEDNSSECBogus, ""), []string{"6 (DNSSEC Bogus)"}},
+		{"with text", ede(EDEProhibited, "not on the list"), []string{"18 (Prohibited): not on the list"}},
+		{"trailing nul", ede(EDEProhibited, "not on the list\x00\x00"), []string{"18 (Prohibited): not on the list"}},
+		{"unknown info code", ede(999, "new"), []string{"999 (Unknown): new"}},
+		{"several", join(ede(EDESignatureExpired, ""), appendEDNSOption(nil, OptionNSID, []byte("ns1")), ede(EDEOther, "and another")),
+			[]string{"7 (Signature Expired)", "0 (Other): and another"}},
+		{"too short for an info code", join(appendEDNSOption(nil, OptionEDE, []byte{0}), ede(15, "")), []string{"15 (Blocked)"}},
+		// the option says it's longer than what's left, so it and anything
+		// after it get dropped
+		{"truncated option", join(ede(EDEDNSSECBogus, ""), ede(EDEProhibited, "text")[:6]), []string{"6 (DNSSEC Bogus)"}},
+		{"truncated header", join(ede(EDEDNSSECBogus, ""), []byte{0, 15}), []string{"6 (DNSSEC Bogus)"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, e := range withOPT(tt.rdata).ExtendedErrors() {
+			got = append(got, e.String())
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if errs := (&DNSMessage{}).ExtendedErrors(); errs != nil {
+		t.Errorf("got %v from a message without OPT", errs)
+	}
+}
+
+func TestMessageStringOPT(t *testing.T) {
+	rdata := appendEDNSOption(nil, OptionNSID, []byte("ns1"))
+	rdata = appendEDE(rdata, ExtendedError{InfoCode: EDEDNSSECBogus, ExtraText: "bad signature"})
+	rdata = appendEDE(rdata, ExtendedError{InfoCode: 999})
+	msg := withOPT(rdata)
+	msg.Additionals[0].TTL = 1 << 15
+	want := "\n;; OPT PSEUDOSECTION:\n" +
+		"; EDNS: version: 0, flags: do; udp: 1232\n" +
+		"; NSID: 6e 73 31 (\"ns1\")\n" +
+		"; EDE: 6 (DNSSEC Bogus): bad signature\n" +
+		"; EDE: 999 (Unknown)\n"
+	if got := msg.String(); !strings.Contains(got, want) {
+		t.Errorf("got:\n%s\nwant it to contain:\n%s", got, want)
+	}
+	// the OPT record is only shown as the pseudosection
+	if strings.Contains(msg.String(), "ADDITIONAL SECTION") {
+		t.Errorf("OPT in the additional section:\n%s", msg)
+	}
+}
+
+func TestEDNSOptionsStopAtBadLength(t *testing.T) {
+	rdata := appendEDNSOption(nil, OptionNSID, []byte("ns1"))
+	rdata = binary.BigEndian.AppendUint16(rdata, OptionEDE)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0xffff)
+	var codes []uint16
+	ednsOptions(&DNSResourceRecord{TYPE: TypeOPT, RDATA: rdata}, func(code uint16, data []byte) {
+		codes = append(codes, code)
+	})
+	if len(codes) != 1 || codes[0] != OptionNSID {
+		t.Errorf("got options %v", codes)
+	}
+}
+
+func TestQueryNSID(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  QueryOptions
+		rdata []byte // of the OPT record, nil for no OPT record
+	}{
+		{"no edns", QueryOptions{}, nil},
+		{"edns", QueryOptions{EDNS: true}, []byte{}},
+		{"nsid", QueryOptions{EDNS: true, NSID: true}, []byte{0, 3, 0, 0}},
+	}
+	for _, tt := range tests {
+		query, err := newQuery("www.example.", TypeA, tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := &DNSMessage{}
+		if err := msg.Unpack(query); err != nil {
+			t.Fatal(err)
+		}
+		opt := msg.OPT()
+		switch {
+		case tt.rdata == nil && opt != nil:
+			t.Errorf("%s: got an OPT record", tt.name)
+		case tt.rdata != nil && opt == nil:
+			t.Errorf("%s: no OPT record", tt.name)
+		case opt != nil && string(opt.RDATA) != string(tt.rdata):
+			t.Errorf("%s: got OPT rdata % x, want % x", tt.name, opt.RDATA, tt.rdata)
+		}
+	}
+}
+
+func TestNSID(t *testing.T) {
+	tests := []struct {
+		name  string
+		msg   *DNSMessage
+		nsid  string
+		found bool
+	}{
+		{"no opt", &DNSMessage{}, "", false},
+		{"no option", withOPT(appendEDE(nil, ExtendedError{InfoCode: EDEOther})), "", false},
+		{"nsid", withOPT(appendEDNSOption(nil, OptionNSID, []byte("ns1.example"))), "ns1.example", true},
+		{"empty", withOPT(appendEDNSOption(nil, OptionNSID, nil)), "", true},
+		{"after an ede", withOPT(appendEDNSOption(appendEDE(nil, ExtendedError{InfoCode: EDEOther}), OptionNSID, []byte("b"))), "b", true},
+		{"first of two", withOPT(appendEDNSOption(appendEDNSOption(nil, OptionNSID, []byte("a")), OptionNSID, []byte("b"))), "a", true},
+	}
+	for _, tt := range tests {
+		nsid, found := tt.msg.NSID()
+		if string(nsid) != tt.nsid || found != tt.found {
+			t.Errorf("%s: got %q, %v", tt.name, nsid, found)
+		}
+	}
+}
+
+func TestNSIDString(t *testing.T) {
+	tests := []struct {
+		nsid []byte
+		want string
+	}{
+		{[]byte("ns1"), `6e 73 31 ("ns1")`},
+		{[]byte{0x00, 'a', 0x7f, 0xff, ' ', '~'}, `00 61 7f ff 20 7e (".a.. ~")`},
+		{[]byte{0xde, 0xad, 0xbe, 0xef}, `de ad be ef ("....")`},
+	}
+	for _, tt := range tests {
+		if got := nsidString(tt.nsid); got != tt.want {
+			t.Errorf("% x: got %s, want %s", tt.nsid, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Servers with both IPv4 and IPv6 addresses get Happy Eyeballs (RFC 8305):
+// their addresses are tried alternating between the families, and the next
+// one is tried alongside the last if it hasn't answered after a short delay,
+// so a host with broken IPv6 doesn't hang waiting on it.
+const (
+	// how long to wait for one address before also trying the next, unless
+	// we know its rtt (RFC 8305 section 5)
+	attemptDelay    = 250 * time.Millisecond
+	minAttemptDelay = 100 * time.Millisecond
+	maxAttemptDelay = 2 * time.Second
+
+	// a family that fails this many times in a row without working in
+	// between gets tried after the other one
+	maxFamilyFailures = 3
+)
+
+// families remembers which address families have been working. It's shared
+// by every client and resolver, since they all go out the same network.
+var families = &familyState{failing: make(map[string]int)}
+
+type familyState struct {
+	mu      sync.Mutex
+	failing map[string]int // failures in a row, by family
+}
+
+func (f *familyState) worked(addr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing[addrFamily(addr)] = 0
+}
+
+func (f *familyState) failed(addr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing[addrFamily(addr)]++
+}
+
+func (f *familyState) broken(family string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.failing[family] >= maxFamilyFailures
+}
+
+// addrFamily returns "ip4" or "ip6" for an address, with or without a port.
+func addrFamily(addr string) string {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return "ip6"
+	}
+	return "ip4"
+}
+
+// interleave reorders addresses to alternate between the families, keeping
+// each family's own order (RFC 8305 section 4). The first address's family
+// goes first, unless it's been failing and the other hasn't.
+func interleave(addrs []string) []string {
+	if len(addrs) < 2 {
+		return addrs
+	}
+	var first, second []string
+	family := addrFamily(addrs[0])
+	for _, addr := range addrs {
+		if addrFamily(addr) == family {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+	if len(second) == 0 {
+		return addrs
+	}
+	if families.broken(family) && !families.broken(addrFamily(second[0])) {
+		first, second = second, first
+	}
+
+	interleaved := make([]string, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			interleaved = append(interleaved, first[i])
+		}
+		if i < len(second) {
+			interleaved = append(interleaved, second[i])
+		}
+	}
+	return interleaved
+}
+
+// nextAttemptDelay is how long to give an address with the given smoothed
+// rtt, zero if unknown, before trying the next one as well.
+func nextAttemptDelay(srtt time.Duration) time.Duration {
+	if srtt == 0 {
+		return attemptDelay
+	}
+	delay := 2 * srtt
+	if delay < minAttemptDelay {
+		delay = minAttemptDelay
+	}
+	if delay > maxAttemptDelay {
+		delay = maxAttemptDelay
+	}
+	return delay
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetFamilies gives the test its own record of which families work, so
+// failures from other tests don't reorder its addresses.
+func resetFamilies(t *testing.T) {
+	saved := families
+	families = &familyState{failing: make(map[string]int)}
+	t.Cleanup(func() { families = saved })
+}
+
+func TestInterleave(t *testing.T) {
+	v4 := []string{"192.0.2.1:53", "192.0.2.2:53"}
+	v6 := []string{"[2001:db8::1]:53", "[2001:db8::2]:53"}
+	fail := func(addr string, times int) func() {
+		return func() {
+			for i := 0; i < times; i++ {
+				families.failed(addr)
+			}
+		}
+	}
+	tests := []struct {
+		name    string
+		history []func()
+		addrs   []string
+		want    []string
+	}{
+		{"one family", nil, v4, v4},
+		{"one address", nil, v6[:1], v6[:1]},
+		{"v4 first", nil, append(append([]string{}, v4...), v6...),
+			[]string{v4[0], v6[0], v4[1], v6[1]}},
+		{"v6 first", nil, []string{v6[0], v6[1], v4[0]},
+			[]string{v6[0], v4[0], v6[1]}},
+		{"no ports", nil, []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"},
+			[]string{"192.0.2.1", "2001:db8::1", "192.0.2.2"}},
+		{"v6 failing but not broken", []func(){fail(v6[0], maxFamilyFailures-1)}, []string{v6[0], v4[0]},
+			[]string{v6[0], v4[0]}},
+		{"v6 broken", []func(){fail(v6[0], maxFamilyFailures)}, []string{v6[0], v6[1], v4[0]},
+			[]string{v4[0], v6[0], v6[1]}},
+		{"v6 broken and working again", []func(){fail(v6[0], maxFamilyFailures), func() { families.worked(v6[1]) }},
+			[]string{v6[0], v4[0]}, []string{v6[0], v4[0]}},
+		{"both broken", []func(){fail(v6[0], maxFamilyFailures), fail(v4[0], maxFamilyFailures)},
+			[]string{v6[0], v4[0]}, []string{v6[0], v4[0]}},
+		{"v6 broken, then v4 too, then v4 worked", []func(){fail(v6[0], maxFamilyFailures), fail(v4[0], maxFamilyFailures), func() { families.worked(v4[1]) }},
+			[]string{v6[0], v4[0]}, []string{v4[0], v6[0]}},
+	}
+	for _, tt := range tests {
+		resetFamilies(t)
+		for _, event := range tt.history {
+			event()
+		}
+		if got := interleave(tt.addrs); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNextAttemptDelay(t *testing.T) {
+	tests := []struct {
+		srtt, want time.Duration
+	}{
+		{0, attemptDelay},
+		{10 * time.Millisecond, minAttemptDelay},
+		{200 * time.Millisecond, 400 * time.Millisecond},
+		{5 * time.Second, maxAttemptDelay},
+	}
+	for _, tt := range tests {
+		if got := nextAttemptDelay(tt.srtt); got != tt.want {
+			t.Errorf("srtt %v: got %v, want %v", tt.srtt, got, tt.want)
+		}
+	}
+}
+
+func TestExchangeEyeballs(t *testing.T) {
+	zone := testZone(t)
+	// a server that takes the query and never answers, and one that's
+	// nothing but a closed port
+	silent := serveFakeUDP(t, "127.0.0.1:0", func(query *DNSMessage) *DNSMessage { return nil })
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		name      string
+		transport string
+		first     string
+		slow      bool // whether the second address should wait for the attempt delay
+		failures  int  // ip4 failures in a row afterwards
+	}{
+		// the silent address still hadn't answered when the second did,
+		// so it counts as failing after the second worked
+		{"udp, first silent", TransportUDP, silent, true, 1},
+		{"tcp, first refused", TransportTCP, closed, false, 0},
+	}
+	for _, tt := range tests {
+		resetFamilies(t)
+		second := serveFake(t, "127.0.0.2:0", zone.answer)
+		client := &Client{Transport: tt.transport, Timeout: 2 * time.Second}
+		query, _ := newQuery("www.example.", TypeA, QueryOptions{})
+		start := time.Now()
+		buf, err := client.exchangeEyeballs([]string{tt.first, second}, query)
+		elapsed := time.Since(start)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		msg := &DNSMessage{}
+		if err := msg.Unpack(buf); err != nil || len(msg.Answers) != 1 {
+			t.Errorf("%s: got %v:\n%s", tt.name, err, msg)
+		}
+		if tt.slow != (elapsed >= attemptDelay) {
+			t.Errorf("%s: took %v with an attempt delay of %v", tt.name, elapsed, attemptDelay)
+		}
+		if got := client.conn.RemoteAddr().String(); got != second {
+			t.Errorf("%s: kept the connection to %s", tt.name, got)
+		}
+		if got := families.failing["ip4"]; got != tt.failures {
+			t.Errorf("%s: ip4 has %d failures, want %d", tt.name, got, tt.failures)
+		}
+		client.Close()
+	}
+}
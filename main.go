@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"flag"
 	"fmt"
 	"net"
 	"os"
@@ -19,7 +20,9 @@ type DNSHeader struct {
 	TC      uint16 // 1bit
 	RD      uint16 // 1bit
 	RA      uint16 // 1bit
-	Z       uint16 // 3bit, MUST be 0
+	Z       uint16 // 1bit, MUST be 0
+	AD      uint16 // 1bit
+	CD      uint16 // 1bit
 	RCODE   uint16 // 4bit
 	QDCOUNT uint16
 	ANCOUNT uint16
@@ -36,8 +39,10 @@ func (h *DNSHeader) Pack() ([]byte, error) {
 	bitfield |= h.TC << 9
 	bitfield |= h.RD << 8
 	bitfield |= h.RA << 7
-	bitfield |= h.Z << 4
-	bitfield |= h.TC << 3
+	bitfield |= h.Z << 6
+	bitfield |= h.AD << 5
+	bitfield |= h.CD << 4
+	bitfield |= h.RCODE
 
 	// assemble the header
 	buf := make([]byte, DNSHeaderLength)
@@ -50,6 +55,53 @@ func (h *DNSHeader) Pack() ([]byte, error) {
 	return buf, nil
 }
 
+func (h *DNSHeader) Unpack(buf []byte) error {
+	if len(buf) < DNSHeaderLength {
+		return fmt.Errorf("header is %d bytes, expected %d", len(buf), DNSHeaderLength)
+	}
+
+	// unpack the bitfields
+	bitfield := binary.BigEndian.Uint16(buf[2:])
+	h.ID = binary.BigEndian.Uint16(buf[0:])
+	h.QR = (bitfield >> 15) & 0x1
+	h.OPCODE = (bitfield >> 11) & 0xf
+	h.AA = (bitfield >> 10) & 0x1
+	h.TC = (bitfield >> 9) & 0x1
+	h.RD = (bitfield >> 8) & 0x1
+	h.RA = (bitfield >> 7) & 0x1
+	h.Z = (bitfield >> 6) & 0x1
+	h.AD = (bitfield >> 5) & 0x1
+	h.CD = (bitfield >> 4) & 0x1
+	h.RCODE = bitfield & 0xf
+	h.QDCOUNT = binary.BigEndian.Uint16(buf[4:])
+	h.ANCOUNT = binary.BigEndian.Uint16(buf[6:])
+	h.NSCOUNT = binary.BigEndian.Uint16(buf[8:])
+	h.ARCOUNT = binary.BigEndian.Uint16(buf[10:])
+	return nil
+}
+
+// Flags lists the header bits that are set, the way dig does.
+func (h *DNSHeader) Flags() string {
+	var flags []string
+	for _, flag := range []struct {
+		name string
+		bit  uint16
+	}{
+		{"qr", h.QR},
+		{"aa", h.AA},
+		{"tc", h.TC},
+		{"rd", h.RD},
+		{"ra", h.RA},
+		{"ad", h.AD},
+		{"cd", h.CD},
+	} {
+		if flag.bit == 1 {
+			flags = append(flags, flag.name)
+		}
+	}
+	return strings.Join(flags, " ")
+}
+
 type DNSQuestion struct {
 	QNAME  string
 	QTYPE  uint16
@@ -57,21 +109,12 @@ type DNSQuestion struct {
 }
 
 func (q *DNSQuestion) Pack() ([]byte, error) {
-	buf := make([]byte, 0, len(q.QNAME)+6)
-	for _, label := range strings.Split(q.QNAME, ".") {
-		length := len(label)
-		if length > 63 {
-			return nil, fmt.Errorf("label '%s' is too long", label)
-		}
-		buf = append(buf, byte(length))
-		buf = append(buf, []byte(label)...)
+	buf, err := packName(q.QNAME)
+	if err != nil {
+		return nil, err
 	}
-	buf = append(buf, 0) // QNAME gets null terminated
 	buf = binary.BigEndian.AppendUint16(buf, q.QTYPE)
-	buf = binary.BigEndian.AppendUint16(buf, q.QTYPE)
-	if len(buf) != len(q.QNAME)+6 {
-		return nil, fmt.Errorf("buffer length is %d, expected %d", len(buf), len(q.QNAME)+5)
-	}
+	buf = binary.BigEndian.AppendUint16(buf, q.QCLASS)
 	return buf, nil
 }
 
@@ -117,41 +160,102 @@ func generateID() uint16 {
 	return binary.BigEndian.Uint16(buf)
 }
 
-func main() {
-	query := os.Args[1]
-	header := DNSHeader{
-		ID:      generateID(),
-		QR:      0,
-		OPCODE:  0,
-		AA:      0,
-		TC:      0,
-		RD:      1,
-		RA:      0,
-		Z:       0,
-		RCODE:   0,
-		QDCOUNT: 1,
-		ANCOUNT: 0,
-		NSCOUNT: 0,
-		ARCOUNT: 0,
-	}
-	packet, err := header.Pack()
-	if err != nil {
-		panic(fmt.Errorf("unable to pack header: %w", err))
+func newQuery(name string, qtype uint16, opts QueryOptions) ([]byte, error) {
+	msg := DNSMessage{
+		Header: DNSHeader{
+			ID:      generateID(),
+			QR:      0,
+			OPCODE:  0,
+			AA:      0,
+			TC:      0,
+			RD:      1,
+			RA:      0,
+			Z:       0,
+			AD:      0,
+			CD:      0,
+			RCODE:   0,
+			QDCOUNT: 1,
+			ANCOUNT: 0,
+			NSCOUNT: 0,
+			ARCOUNT: 0,
+		},
+		Questions: []DNSQuestion{{
+			QNAME:  name,
+			QTYPE:  qtype,
+			QCLASS: ClassINET,
+		}},
+	}
+	if opts.NoRecursion {
+		msg.Header.RD = 0
 	}
+	if opts.EDNS {
+		msg.Additionals = append(msg.Additionals, opts.opt())
+	}
+	return msg.Pack()
+}
 
-	question := DNSQuestion{
-		QNAME:  query,
-		QTYPE:  1,
-		QCLASS: 1,
+// parseInterspersed parses flags that come before, between or after the
+// positional arguments, and returns the positional arguments.
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
 	}
-	buf, err := question.Pack()
-	if err != nil {
-		panic(fmt.Errorf("unable to pack question: %w", err))
+}
+
+var commands = map[string]func(args []string) error{
+	"assert":     assertMain,
+	"batch":      batchMain,
+	"bench":      benchMain,
+	"check-zone": checkZoneMain,
+	"compare":    compareMain,
+	"dnstap":     dnstapMain,
+	"probe":      probeMain,
+	"recursor":   recursorMain,
+	"trace":      traceMain,
+	"watch":      watchMain,
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: dunce <name>")
+	fmt.Fprintln(os.Stderr, "       dunce <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  assert      check DNS records against a YAML spec of expectations")
+	fmt.Fprintln(os.Stderr, "  batch       run queries from a file or stdin and print the results")
+	fmt.Fprintln(os.Stderr, "  bench       send queries at a target rate and report throughput and latency")
+	fmt.Fprintln(os.Stderr, "  check-zone  check a zone's delegation and nameservers for consistency")
+	fmt.Fprintln(os.Stderr, "  compare     query several servers and show where their answers differ")
+	fmt.Fprintln(os.Stderr, "  dnstap      read a dnstap file and print the messages in it")
+	fmt.Fprintln(os.Stderr, "  probe       run queries periodically and export Prometheus metrics")
+	fmt.Fprintln(os.Stderr, "  recursor    answer queries by resolving them from the root servers down")
+	fmt.Fprintln(os.Stderr, "  trace       resolve a name from the root servers down, showing each step")
+	fmt.Fprintln(os.Stderr, "  watch       repeat a query and highlight changes in the answers")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	if cmd, ok := commands[os.Args[1]]; ok {
+		if err := cmd(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "dunce %s: %v\n", os.Args[1], err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	packet = append(packet, buf...)
-	if len(packet) != DNSHeaderLength+len(query)+6 {
-		panic("unexpected packet length")
+	query := os.Args[1]
+	packet, err := newQuery(query, TypeA, QueryOptions{})
+	if err != nil {
+		panic(err)
 	}
 	printBuf(packet)
 
@@ -166,7 +270,7 @@ func main() {
 		panic("unable to write full request")
 	}
 
-	buf = make([]byte, 512)
+	buf := make([]byte, 512)
 	n, err = conn.Read(buf)
 	if err != nil {
 		panic(fmt.Errorf("error reading response from network: %w", err))
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureStdout runs f and returns what it printed.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	out := make(chan string)
+	go func() {
+		buf, _ := io.ReadAll(r)
+		out <- string(buf)
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+func TestDNSHeaderPack(t *testing.T) {
+	tests := []struct {
+		name   string
+		header DNSHeader
+		want   []byte
+	}{
+		{"query", DNSHeader{ID: 0x1234, RD: 1, QDCOUNT: 1}, []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}},
+		{"truncated", DNSHeader{QR: 1, TC: 1}, []byte{0, 0, 0x82, 0x00, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{"nxdomain", DNSHeader{QR: 1, AA: 1, RD: 1, RA: 1, RCODE: 3, QDCOUNT: 1, NSCOUNT: 1}, []byte{0, 0, 0x85, 0x83, 0, 1, 0, 0, 0, 1, 0, 0}},
+		{"opcode", DNSHeader{OPCODE: 5, RCODE: 15, ARCOUNT: 2}, []byte{0, 0, 0x28, 0x0f, 0, 0, 0, 0, 0, 0, 0, 2}},
+	}
+	for _, tt := range tests {
+		got, err := tt.header.Pack()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got % x, want % x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDNSQuestionPack(t *testing.T) {
+	q := DNSQuestion{QNAME: "example.com", QTYPE: 28, QCLASS: 1}
+	got, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 28, 0, 1}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+}
+
+func TestDNSHeaderUnpack(t *testing.T) {
+	headers := []DNSHeader{
+		{ID: 0x1234, RD: 1, QDCOUNT: 1},
+		{ID: 0xffff, QR: 1, OPCODE: 5, AA: 1, TC: 1, RD: 1, RA: 1, Z: 1, AD: 1, CD: 1, RCODE: 15, QDCOUNT: 1, ANCOUNT: 2, NSCOUNT: 3, ARCOUNT: 4},
+	}
+	for _, h := range headers {
+		buf, err := h.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got DNSHeader
+		if err := got.Unpack(buf); err != nil {
+			t.Fatal(err)
+		}
+		if got != h {
+			t.Errorf("got %+v, want %+v", got, h)
+		}
+	}
+
+	var h DNSHeader
+	if err := h.Unpack(make([]byte, DNSHeaderLength-1)); err == nil {
+		t.Error("unpacked a short header")
+	}
+}
+
+func TestDNSQuestionPackNames(t *testing.T) {
+	tests := []struct {
+		name string
+		want []byte
+		err  bool
+	}{
+		{"example.com.", []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0}, false},
+		{".", []byte{0}, false},
+		{"example..com", nil, true},
+		{strings.Repeat("a", 64) + ".com", nil, true},
+		{strings.Repeat("a.", 128) + "com", nil, true},
+	}
+	for _, tt := range tests {
+		q := DNSQuestion{QNAME: tt.name, QTYPE: 1, QCLASS: 1}
+		got, err := q.Pack()
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: packed a bad name", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if want := append(tt.want, 0, 1, 0, 1); !bytes.Equal(got, want) {
+			t.Errorf("%s: got % x, want % x", tt.name, got, want)
+		}
+	}
+}
+
+func TestUnpackRDATA(t *testing.T) {
+	longTag := append([]byte{0, 255}, bytes.Repeat([]byte{'a'}, 300)...)
+	tests := []struct {
+		name   string
+		rrtype uint16
+		buf    []byte
+		length int // of the rdata at the start of buf, all of it if zero
+		data   string
+		err    bool
+	}{
+		{"a", TypeA, []byte{192, 0, 2, 1}, 0, "192.0.2.1", false},
+		{"short a", TypeA, []byte{192, 0, 2}, 0, "", true},
+		{"long aaaa", TypeAAAA, make([]byte, 17), 0, "", true},
+		{"ns", TypeNS, []byte{2, 'n', 's', 0}, 0, "ns.", false},
+		{"ns label past the end", TypeNS, []byte{5, 'n', 's'}, 0, "", true},
+		{"ns past the rdata", TypeNS, []byte{2, 'n', 's', 0}, 2, "", true},
+		{"ns forward pointer", TypeNS, []byte{0xc0, 0x00}, 0, "", true},
+		{"ns bad label type", TypeNS, []byte{0x40, 0}, 0, "", true},
+		{"mx", TypeMX, []byte{0, 10, 2, 'm', 'x', 0}, 0, "10 mx.", false},
+		{"short mx", TypeMX, []byte{0}, 0, "", true},
+		{"soa without numbers", TypeSOA, []byte{0, 0, 0, 0, 0, 1}, 0, "", true},
+		{"short srv", TypeSRV, []byte{0, 1, 0, 2}, 0, "", true},
+		{"txt", TypeTXT, []byte{2, 'h', 'i', 1, '"'}, 0, `"hi" "\""`, false},
+		{"txt past the end", TypeTXT, []byte{3, 'h', 'i'}, 0, "", true},
+		{"caa", TypeCAA, append([]byte{0, 5}, "issueca.example"...), 0, `0 issue "ca.example"`, false},
+		{"empty caa", TypeCAA, []byte{0}, 0, "", true},
+		{"caa tag past the end", TypeCAA, []byte{0, 5, 'i', 's'}, 0, "", true},
+		{"caa 255 byte tag", TypeCAA, longTag, 0, "0 " + strings.Repeat("a", 255) + ` "` + strings.Repeat("a", 45) + `"`, false},
+		{"short ds", TypeDS, []byte{0, 1, 13}, 0, "", true},
+		{"short dnskey", TypeDNSKEY, []byte{1, 1, 3}, 0, "", true},
+		{"short rrsig", TypeRRSIG, make([]byte, 17), 0, "", true},
+		{"rrsig signer past the end", TypeRRSIG, append(make([]byte, 18), 3, 'c'), 0, "", true},
+		{"nsec truncated bitmap", TypeNSEC, []byte{0, 0}, 0, "", true},
+		{"nsec empty window", TypeNSEC, []byte{0, 0, 0}, 0, "", true},
+		{"nsec3 salt past the end", TypeNSEC3, []byte{1, 0, 0, 0, 4, 1}, 0, "", true},
+		{"nsec3 hash past the end", TypeNSEC3, []byte{1, 0, 0, 0, 0, 20, 1}, 0, "", true},
+		{"unknown", 65280, []byte{1, 2}, 0, `\# 2 0102`, false},
+	}
+	for _, tt := range tests {
+		length := tt.length
+		if length == 0 {
+			length = len(tt.buf)
+		}
+		_, data, err := unpackRDATA(tt.buf, 0, length, tt.rrtype)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: unpacked as %q", tt.name, data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if data != tt.data {
+			t.Errorf("%s: got %q, want %q", tt.name, data, tt.data)
+		}
+	}
+}
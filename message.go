@@ -0,0 +1,589 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type DNSResourceRecord struct {
+	NAME  string
+	TYPE  uint16
+	CLASS uint16
+	TTL   uint32
+	RDATA []byte // with any compressed names expanded
+	Data  string // RDATA in presentation format
+}
+
+func (rr *DNSResourceRecord) Pack() ([]byte, error) {
+	buf, err := packName(rr.NAME)
+	if err != nil {
+		return nil, err
+	}
+	if len(rr.RDATA) > 65535 {
+		return nil, fmt.Errorf("rdata is %d bytes, which is too long", len(rr.RDATA))
+	}
+	buf = binary.BigEndian.AppendUint16(buf, rr.TYPE)
+	buf = binary.BigEndian.AppendUint16(buf, rr.CLASS)
+	buf = binary.BigEndian.AppendUint32(buf, rr.TTL)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(rr.RDATA)))
+	return append(buf, rr.RDATA...), nil
+}
+
+func (rr *DNSResourceRecord) String() string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", rr.NAME, rr.TTL, classString(rr.CLASS), typeString(rr.TYPE), rr.Data)
+}
+
+type DNSMessage struct {
+	Header      DNSHeader
+	Questions   []DNSQuestion
+	Answers     []DNSResourceRecord
+	Authorities []DNSResourceRecord
+	Additionals []DNSResourceRecord
+}
+
+// Pack encodes the message without name compression, filling in the header
+// counts from the sections.
+func (m *DNSMessage) Pack() ([]byte, error) {
+	m.Header.QDCOUNT = uint16(len(m.Questions))
+	m.Header.ANCOUNT = uint16(len(m.Answers))
+	m.Header.NSCOUNT = uint16(len(m.Authorities))
+	m.Header.ARCOUNT = uint16(len(m.Additionals))
+	packet, err := m.Header.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("unable to pack header: %w", err)
+	}
+
+	for _, q := range m.Questions {
+		buf, err := q.Pack()
+		if err != nil {
+			return nil, fmt.Errorf("unable to pack question: %w", err)
+		}
+		packet = append(packet, buf...)
+	}
+	for _, section := range [][]DNSResourceRecord{m.Answers, m.Authorities, m.Additionals} {
+		for _, rr := range section {
+			buf, err := rr.Pack()
+			if err != nil {
+				return nil, fmt.Errorf("unable to pack %s record for %s: %w", typeString(rr.TYPE), rr.NAME, err)
+			}
+			packet = append(packet, buf...)
+		}
+	}
+	return packet, nil
+}
+
+func (m *DNSMessage) Unpack(buf []byte) error {
+	if err := m.Header.Unpack(buf); err != nil {
+		return err
+	}
+
+	off := DNSHeaderLength
+	m.Questions = make([]DNSQuestion, 0, m.Header.QDCOUNT)
+	for i := 0; i < int(m.Header.QDCOUNT); i++ {
+		name, next, err := unpackName(buf, off)
+		if err != nil {
+			return fmt.Errorf("unable to unpack question: %w", err)
+		}
+		if next+4 > len(buf) {
+			return errors.New("unable to unpack question: message is truncated")
+		}
+		m.Questions = append(m.Questions, DNSQuestion{
+			QNAME:  name,
+			QTYPE:  binary.BigEndian.Uint16(buf[next:]),
+			QCLASS: binary.BigEndian.Uint16(buf[next+2:]),
+		})
+		off = next + 4
+	}
+
+	var err error
+	if m.Answers, off, err = unpackSection(buf, off, m.Header.ANCOUNT); err != nil {
+		return fmt.Errorf("unable to unpack answer section: %w", err)
+	}
+	if m.Authorities, off, err = unpackSection(buf, off, m.Header.NSCOUNT); err != nil {
+		return fmt.Errorf("unable to unpack authority section: %w", err)
+	}
+	if m.Additionals, _, err = unpackSection(buf, off, m.Header.ARCOUNT); err != nil {
+		return fmt.Errorf("unable to unpack additional section: %w", err)
+	}
+	return nil
+}
+
+func unpackSection(buf []byte, off int, count uint16) ([]DNSResourceRecord, int, error) {
+	records := make([]DNSResourceRecord, 0, count)
+	for i := 0; i < int(count); i++ {
+		var rr DNSResourceRecord
+		var err error
+		if off, err = rr.unpack(buf, off); err != nil {
+			return nil, off, err
+		}
+		records = append(records, rr)
+	}
+	return records, off, nil
+}
+
+func (rr *DNSResourceRecord) unpack(buf []byte, off int) (int, error) {
+	name, off, err := unpackName(buf, off)
+	if err != nil {
+		return off, err
+	}
+	if off+10 > len(buf) {
+		return off, errors.New("message is truncated")
+	}
+	rr.NAME = name
+	rr.TYPE = binary.BigEndian.Uint16(buf[off:])
+	rr.CLASS = binary.BigEndian.Uint16(buf[off+2:])
+	rr.TTL = binary.BigEndian.Uint32(buf[off+4:])
+	length := int(binary.BigEndian.Uint16(buf[off+8:]))
+	off += 10
+	if off+length > len(buf) {
+		return off, errors.New("message is truncated")
+	}
+	if rr.RDATA, rr.Data, err = unpackRDATA(buf, off, length, rr.TYPE); err != nil {
+		return off, fmt.Errorf("unable to unpack %s record for %s: %w", typeString(rr.TYPE), rr.NAME, err)
+	}
+	return off + length, nil
+}
+
+// unpackName reads a possibly compressed name starting at off, and returns
+// it in presentation format along with the offset just past it.
+func unpackName(buf []byte, off int) (string, int, error) {
+	labels, next, err := readLabels(buf, off)
+	if err != nil {
+		return "", 0, err
+	}
+	return joinLabels(labels), next, nil
+}
+
+// joinLabels is the inverse of splitName, always giving a fully qualified
+// name.
+func joinLabels(labels [][]byte) string {
+	escaped := make([]string, len(labels))
+	for i, label := range labels {
+		escaped[i] = escapeLabel(label)
+	}
+	return strings.Join(escaped, ".") + "."
+}
+
+func readLabels(buf []byte, off int) ([][]byte, int, error) {
+	var labels [][]byte
+	end := -1 // where the name ends in the original position, once we jump
+	length := 1
+	for {
+		if off >= len(buf) {
+			return nil, 0, errors.New("name runs off the end of the message")
+		}
+		b := int(buf[off])
+		switch b & 0xc0 {
+		case 0x00:
+			if b == 0 {
+				if end < 0 {
+					end = off + 1
+				}
+				return labels, end, nil
+			}
+			if off+1+b > len(buf) {
+				return nil, 0, errors.New("label runs off the end of the message")
+			}
+			length += b + 1
+			if length > 255 {
+				return nil, 0, errors.New("name is too long")
+			}
+			labels = append(labels, buf[off+1:off+1+b])
+			off += 1 + b
+		case 0xc0:
+			if off+2 > len(buf) {
+				return nil, 0, errors.New("pointer runs off the end of the message")
+			}
+			ptr := int(binary.BigEndian.Uint16(buf[off:]) & 0x3fff)
+			// only following pointers backwards rules out loops
+			if ptr >= off {
+				return nil, 0, errors.New("name has a forward pointer")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = ptr
+		default:
+			return nil, 0, fmt.Errorf("unknown label type 0x%02x", b&0xc0)
+		}
+	}
+}
+
+// packName encodes a presentation format name without compression.
+func packName(name string) ([]byte, error) {
+	labels, err := splitName(name)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, len(name)+2)
+	for _, label := range labels {
+		if len(label) > 63 {
+			return nil, fmt.Errorf("label '%s' is too long", label)
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+	buf = append(buf, 0) // names get null terminated
+	if len(buf) > 255 {
+		return nil, fmt.Errorf("name '%s' is too long", name)
+	}
+	return buf, nil
+}
+
+// splitName breaks a presentation format name into its labels, undoing any
+// escapes. The trailing dot of a fully qualified name is optional, and the
+// root is the only name with no labels.
+func splitName(name string) ([][]byte, error) {
+	if name == "." || name == "" {
+		return nil, nil
+	}
+	var labels [][]byte
+	var label []byte
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case '\\':
+			if i+3 < len(name) && isDigit(name[i+1]) && isDigit(name[i+2]) && isDigit(name[i+3]) {
+				n, _ := strconv.Atoi(name[i+1 : i+4])
+				if n > 255 {
+					return nil, fmt.Errorf("name '%s' has a bad escape", name)
+				}
+				label = append(label, byte(n))
+				i += 3
+			} else if i+1 < len(name) {
+				label = append(label, name[i+1])
+				i++
+			} else {
+				return nil, fmt.Errorf("name '%s' ends in a backslash", name)
+			}
+		case '.':
+			if len(label) == 0 {
+				return nil, fmt.Errorf("name '%s' has an empty label", name)
+			}
+			labels = append(labels, label)
+			label = nil
+		default:
+			label = append(label, c)
+		}
+	}
+	if len(label) > 0 {
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func escapeLabel(label []byte) string {
+	var sb strings.Builder
+	for _, c := range label {
+		switch {
+		case c == '.' || c == '\\' || c == '"' || c == '(' || c == ')' || c == ';' || c == '@' || c == '$':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c <= ' ' || c >= 0x7f:
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+func unpackRDATA(buf []byte, off, length int, rrtype uint16) ([]byte, string, error) {
+	rdata := buf[off : off+length]
+	end := off + length
+
+	// names in these types may be compressed, so they get expanded into a
+	// fresh copy of the RDATA
+	names := func(prefix int, count int, suffix int) ([]byte, []string, error) {
+		if prefix > length {
+			return nil, nil, errors.New("rdata is too short")
+		}
+		expanded := append([]byte{}, rdata[:prefix]...)
+		var presentation []string
+		p := off + prefix
+		for i := 0; i < count; i++ {
+			name, next, err := unpackName(buf, p)
+			if err != nil {
+				return nil, nil, err
+			}
+			if next > end {
+				return nil, nil, errors.New("name runs past the end of the rdata")
+			}
+			labels, _, _ := readLabels(buf, p)
+			for _, label := range labels {
+				expanded = append(expanded, byte(len(label)))
+				expanded = append(expanded, label...)
+			}
+			expanded = append(expanded, 0)
+			presentation = append(presentation, name)
+			p = next
+		}
+		if end-p != suffix {
+			return nil, nil, fmt.Errorf("rdata has %d bytes after names, expected %d", end-p, suffix)
+		}
+		return append(expanded, buf[p:end]...), presentation, nil
+	}
+
+	switch rrtype {
+	case TypeA:
+		if length != 4 {
+			return nil, "", errors.New("rdata is not 4 bytes")
+		}
+		return rdata, net.IP(rdata).String(), nil
+	case TypeAAAA:
+		if length != 16 {
+			return nil, "", errors.New("rdata is not 16 bytes")
+		}
+		return rdata, net.IP(rdata).String(), nil
+	case TypeNS, TypeCNAME, TypePTR, TypeDNAME:
+		expanded, n, err := names(0, 1, 0)
+		if err != nil {
+			return nil, "", err
+		}
+		return expanded, n[0], nil
+	case TypeMX:
+		expanded, n, err := names(2, 1, 0)
+		if err != nil {
+			return nil, "", err
+		}
+		return expanded, fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rdata), n[0]), nil
+	case TypeSOA:
+		expanded, n, err := names(0, 2, 20)
+		if err != nil {
+			return nil, "", err
+		}
+		tail := expanded[len(expanded)-20:]
+		return expanded, fmt.Sprintf("%s %s %d %d %d %d %d", n[0], n[1],
+			binary.BigEndian.Uint32(tail[0:]),
+			binary.BigEndian.Uint32(tail[4:]),
+			binary.BigEndian.Uint32(tail[8:]),
+			binary.BigEndian.Uint32(tail[12:]),
+			binary.BigEndian.Uint32(tail[16:])), nil
+	case TypeSRV:
+		expanded, n, err := names(6, 1, 0)
+		if err != nil {
+			return nil, "", err
+		}
+		return expanded, fmt.Sprintf("%d %d %d %s",
+			binary.BigEndian.Uint16(rdata[0:]),
+			binary.BigEndian.Uint16(rdata[2:]),
+			binary.BigEndian.Uint16(rdata[4:]),
+			n[0]), nil
+	}
+
+	data, err := rdataString(rdata, rrtype)
+	return rdata, data, err
+}
+
+// rdataString formats RDATA that has no compressed names in it.
+func rdataString(rdata []byte, rrtype uint16) (string, error) {
+	switch rrtype {
+	case TypeTXT, TypeHINFO:
+		var strs []string
+		for p := 0; p < len(rdata); {
+			l := int(rdata[p])
+			if p+1+l > len(rdata) {
+				return "", errors.New("string runs past the end of the rdata")
+			}
+			strs = append(strs, quoteString(rdata[p+1:p+1+l]))
+			p += 1 + l
+		}
+		return strings.Join(strs, " "), nil
+	case TypeCAA:
+		if len(rdata) < 2 {
+			return "", errors.New("rdata is too short")
+		}
+		end := 2 + int(rdata[1])
+		if end > len(rdata) {
+			return "", errors.New("tag runs past the end of the rdata")
+		}
+		return fmt.Sprintf("%d %s %s", rdata[0], rdata[2:end], quoteString(rdata[end:])), nil
+	case TypeDS:
+		if len(rdata) < 4 {
+			return "", errors.New("rdata is too short")
+		}
+		return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(rdata), rdata[2], rdata[3],
+			strings.ToUpper(hex.EncodeToString(rdata[4:]))), nil
+	case TypeDNSKEY:
+		if len(rdata) < 4 {
+			return "", errors.New("rdata is too short")
+		}
+		return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(rdata), rdata[2], rdata[3],
+			base64.StdEncoding.EncodeToString(rdata[4:])), nil
+	case TypeRRSIG:
+		if len(rdata) < 18 {
+			return "", errors.New("rdata is too short")
+		}
+		signer, next, err := unpackName(rdata, 18)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %d %d %d %s %s %d %s %s",
+			typeString(binary.BigEndian.Uint16(rdata[0:])),
+			rdata[2],
+			rdata[3],
+			binary.BigEndian.Uint32(rdata[4:]),
+			sigTimeString(binary.BigEndian.Uint32(rdata[8:])),
+			sigTimeString(binary.BigEndian.Uint32(rdata[12:])),
+			binary.BigEndian.Uint16(rdata[16:]),
+			signer,
+			base64.StdEncoding.EncodeToString(rdata[next:])), nil
+	case TypeNSEC:
+		next, p, err := unpackName(rdata, 0)
+		if err != nil {
+			return "", err
+		}
+		types, err := typeBitmapString(rdata[p:])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(next + " " + types), nil
+	case TypeNSEC3:
+		if len(rdata) < 5 || 5+int(rdata[4]) >= len(rdata) {
+			return "", errors.New("rdata is too short")
+		}
+		salt := "-"
+		saltEnd := 5 + int(rdata[4])
+		if rdata[4] > 0 {
+			salt = strings.ToUpper(hex.EncodeToString(rdata[5:saltEnd]))
+		}
+		hashEnd := saltEnd + 1 + int(rdata[saltEnd])
+		if hashEnd > len(rdata) {
+			return "", errors.New("rdata is too short")
+		}
+		types, err := typeBitmapString(rdata[hashEnd:])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(fmt.Sprintf("%d %d %d %s %s %s", rdata[0], rdata[1],
+			binary.BigEndian.Uint16(rdata[2:]),
+			salt,
+			base32.HexEncoding.WithPadding(base32.NoPadding).EncodeToString(rdata[saltEnd+1:hashEnd]),
+			types)), nil
+	}
+
+	// RFC 3597 generic format for everything else
+	return fmt.Sprintf("\\# %d %s", len(rdata), hex.EncodeToString(rdata)), nil
+}
+
+func quoteString(s []byte) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+func sigTimeString(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format("20060102150405")
+}
+
+// typeBitmapString formats the type bitmaps from NSEC and NSEC3 records.
+func typeBitmapString(bitmap []byte) (string, error) {
+	var types []string
+	for p := 0; p < len(bitmap); {
+		if p+2 > len(bitmap) {
+			return "", errors.New("type bitmap is truncated")
+		}
+		window, length := int(bitmap[p]), int(bitmap[p+1])
+		if length == 0 || length > 32 || p+2+length > len(bitmap) {
+			return "", errors.New("type bitmap is malformed")
+		}
+		for i, b := range bitmap[p+2 : p+2+length] {
+			for bit := 0; bit < 8; bit++ {
+				if b&(0x80>>bit) != 0 {
+					types = append(types, typeString(uint16(window*256+i*8+bit)))
+				}
+			}
+		}
+		p += 2 + length
+	}
+	return strings.Join(types, " "), nil
+}
+
+func classString(class uint16) string {
+	if class == ClassINET {
+		return "IN"
+	}
+	return "CLASS" + strconv.Itoa(int(class))
+}
+
+// canonicalName lower cases a name and makes it fully qualified, so names
+// can be compared as strings.
+func canonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// String formats the message the way dig does.
+func (m *DNSMessage) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, ";; opcode: %s, status: %s, id: %d\n", opcodeString(m.Header.OPCODE), rcodeString(m.Rcode()), m.Header.ID)
+	fmt.Fprintf(&sb, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		m.Header.Flags(), len(m.Questions), len(m.Answers), len(m.Authorities), len(m.Additionals))
+
+	if opt := m.OPT(); opt != nil {
+		sb.WriteString("\n;; OPT PSEUDOSECTION:\n")
+		flags := ""
+		if opt.TTL&(1<<15) != 0 {
+			flags = " do"
+		}
+		fmt.Fprintf(&sb, "; EDNS: version: %d, flags:%s; udp: %d\n", ednsVersion(opt), flags, opt.CLASS)
+		if nsid, ok := m.NSID(); ok {
+			fmt.Fprintf(&sb, "; NSID: %s\n", nsidString(nsid))
+		}
+		for _, e := range m.ExtendedErrors() {
+			fmt.Fprintf(&sb, "; EDE: %s\n", e)
+		}
+	}
+
+	if len(m.Questions) > 0 {
+		sb.WriteString("\n;; QUESTION SECTION:\n")
+		for _, q := range m.Questions {
+			fmt.Fprintf(&sb, ";%s\t\t%s\t%s\n", q.QNAME, classString(q.QCLASS), typeString(q.QTYPE))
+		}
+	}
+	for _, section := range []struct {
+		name    string
+		records []DNSResourceRecord
+	}{
+		{"ANSWER", m.Answers},
+		{"AUTHORITY", m.Authorities},
+		{"ADDITIONAL", m.Additionals},
+	} {
+		var lines []string
+		for i := range section.records {
+			if section.records[i].TYPE != TypeOPT {
+				lines = append(lines, section.records[i].String())
+			}
+		}
+		if len(lines) > 0 {
+			fmt.Fprintf(&sb, "\n;; %s SECTION:\n%s\n", section.name, strings.Join(lines, "\n"))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// probeBuckets are the upper bounds of the latency histogram, in seconds.
+var probeBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// probeConfig is the YAML file of probes to run, like:
+//
+//	interval: 30s
+//	probes:
+//	  - name: www.example.com
+//	    type: A
+//	    server: 8.8.8.8
+//	  - name: example.com
+//	    type: SOA
+//	    server: tls://1.1.1.1
+//	    dnssec: true
+//	    interval: 5m
+type probeConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Probes   []*probe      `yaml:"probes"`
+}
+
+type probe struct {
+	Name     string        `yaml:"name"`
+	Type     string        `yaml:"type"`
+	Server   string        `yaml:"server"`
+	DNSSEC   bool          `yaml:"dnssec"`
+	Interval time.Duration `yaml:"interval"`
+
+	qtype  uint16
+	labels string
+	client *Client
+
+	// everything below is guarded by mu
+	mu         sync.Mutex
+	ran        bool
+	success    bool
+	rcode      uint16
+	answers    int
+	expiration time.Time // earliest RRSIG expiration, zero without one
+	total      uint64
+	failures   uint64
+	responses  map[uint16]uint64
+	buckets    []uint64
+	sum        float64
+}
+
+func probeMain(args []string) error {
+	flags := flag.NewFlagSet("probe", flag.ExitOnError)
+	configFile := flags.String("config", "probes.yaml", "YAML file of probes to run")
+	listen := flags.String("listen", ":9153", "address to serve /metrics on")
+	transport := flags.String("transport", TransportUDP, "transport for servers without a scheme: udp, tcp, tls or https")
+	flags.Parse(args)
+
+	config, err := readProbeConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	// a probe without a client would just be missing from /metrics, so
+	// better to not start at all
+	for _, p := range config.Probes {
+		if p.client, err = newClientForSpec(p.Server, *transport, config.Timeout); err != nil {
+			return fmt.Errorf("probe %s %s @%s: %w", p.Name, p.Type, p.Server, err)
+		}
+		if p.DNSSEC {
+			p.client.Options = QueryOptions{EDNS: true, DNSSECOK: true}
+		}
+	}
+	for _, p := range config.Probes {
+		go p.run()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeProbeMetrics(w, config.Probes, time.Now())
+	})
+	log.Printf("serving metrics for %d probes on %s/metrics", len(config.Probes), *listen)
+	return http.ListenAndServe(*listen, mux)
+}
+
+func readProbeConfig(path string) (*probeConfig, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config: %w", err)
+	}
+	config := &probeConfig{Interval: 30 * time.Second, Timeout: 5 * time.Second}
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	// a misspelt key would otherwise quietly get the default instead
+	dec.KnownFields(true)
+	if err := dec.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unable to parse config: %w", err)
+	}
+	if len(config.Probes) == 0 {
+		return nil, fmt.Errorf("no probes in %s", path)
+	}
+
+	for i, p := range config.Probes {
+		if p.Name == "" {
+			return nil, fmt.Errorf("probe %d has no name", i+1)
+		}
+		if p.Type == "" {
+			p.Type = "A"
+		}
+		if p.qtype, err = parseType(p.Type); err != nil {
+			return nil, fmt.Errorf("probe %d: %w", i+1, err)
+		}
+		if p.Server == "" {
+			p.Server = "8.8.8.8"
+		}
+		if p.Interval == 0 {
+			p.Interval = config.Interval
+		}
+		if p.Interval <= 0 {
+			return nil, fmt.Errorf("probe %d: interval must be positive", i+1)
+		}
+		p.labels = fmt.Sprintf(`name="%s",type="%s",server="%s"`,
+			escapeLabelValue(p.Name), escapeLabelValue(typeString(p.qtype)), escapeLabelValue(p.Server))
+		p.responses = make(map[uint16]uint64)
+		p.buckets = make([]uint64, len(probeBuckets))
+	}
+	return config, nil
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func (p *probe) run() {
+	defer p.client.Close()
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		msg, err := p.client.Query(p.Name, p.qtype)
+		p.record(msg, time.Since(start), err)
+		<-ticker.C
+	}
+}
+
+func (p *probe) record(msg *DNSMessage, latency time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ran = true
+	p.total++
+	if err != nil {
+		p.success = false
+		p.failures++
+		return
+	}
+
+	p.rcode = msg.Rcode()
+	p.success = p.rcode == RcodeSuccess
+	if !p.success {
+		p.failures++
+	}
+	p.responses[p.rcode]++
+	p.answers = len(msg.Answers)
+	p.expiration = earliestExpiration(msg.Answers)
+
+	seconds := latency.Seconds()
+	p.sum += seconds
+	for i, bound := range probeBuckets {
+		if seconds <= bound {
+			p.buckets[i]++
+		}
+	}
+}
+
+// earliestExpiration returns when the first of the RRSIGs among the records
+// expires, or the zero time if there are none.
+func earliestExpiration(records []DNSResourceRecord) time.Time {
+	var earliest time.Time
+	for _, rr := range records {
+		if rr.TYPE != TypeRRSIG || len(rr.RDATA) < 12 {
+			continue
+		}
+		expiration := time.Unix(int64(binary.BigEndian.Uint32(rr.RDATA[8:])), 0)
+		if earliest.IsZero() || expiration.Before(earliest) {
+			earliest = expiration
+		}
+	}
+	return earliest
+}
+
+type metric struct {
+	name, kind, help string
+	write            func(w io.Writer, p *probe)
+}
+
+func writeProbeMetrics(w io.Writer, probes []*probe, now time.Time) {
+	metrics := []metric{
+		{"dunce_probe_success", "gauge", "Whether the last probe got a NOERROR response.", func(w io.Writer, p *probe) {
+			fmt.Fprintf(w, "dunce_probe_success{%s} %d\n", p.labels, boolInt(p.success))
+		}},
+		{"dunce_probe_rcode", "gauge", "Response code of the last response.", func(w io.Writer, p *probe) {
+			if len(p.responses) > 0 {
+				fmt.Fprintf(w, "dunce_probe_rcode{%s} %d\n", p.labels, p.rcode)
+			}
+		}},
+		{"dunce_probe_responses_total", "counter", "Responses by response code.", func(w io.Writer, p *probe) {
+			rcodes := make([]uint16, 0, len(p.responses))
+			for rcode := range p.responses {
+				rcodes = append(rcodes, rcode)
+			}
+			sort.Slice(rcodes, func(i, j int) bool { return rcodes[i] < rcodes[j] })
+			for _, rcode := range rcodes {
+				fmt.Fprintf(w, "dunce_probe_responses_total{%s,rcode=\"%s\"} %d\n", p.labels, rcodeString(rcode), p.responses[rcode])
+			}
+		}},
+		{"dunce_probe_runs_total", "counter", "Probes run.", func(w io.Writer, p *probe) {
+			fmt.Fprintf(w, "dunce_probe_runs_total{%s} %d\n", p.labels, p.total)
+		}},
+		{"dunce_probe_failures_total", "counter", "Probes that got no response or an error response code.", func(w io.Writer, p *probe) {
+			fmt.Fprintf(w, "dunce_probe_failures_total{%s} %d\n", p.labels, p.failures)
+		}},
+		{"dunce_probe_duration_seconds", "histogram", "Time from sending the query to decoding the response.", func(w io.Writer, p *probe) {
+			var count uint64
+			for _, n := range p.responses {
+				count += n
+			}
+			for i, bound := range probeBuckets {
+				fmt.Fprintf(w, "dunce_probe_duration_seconds_bucket{%s,le=\"%g\"} %d\n", p.labels, bound, p.buckets[i])
+			}
+			fmt.Fprintf(w, "dunce_probe_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", p.labels, count)
+			fmt.Fprintf(w, "dunce_probe_duration_seconds_sum{%s} %g\n", p.labels, p.sum)
+			fmt.Fprintf(w, "dunce_probe_duration_seconds_count{%s} %d\n", p.labels, count)
+		}},
+		{"dunce_probe_answer_count", "gauge", "Records in the answer section of the last response.", func(w io.Writer, p *probe) {
+			if len(p.responses) > 0 {
+				fmt.Fprintf(w, "dunce_probe_answer_count{%s} %d\n", p.labels, p.answers)
+			}
+		}},
+		{"dunce_probe_rrsig_expiration_seconds", "gauge", "Seconds until the first RRSIG in the last answer expires.", func(w io.Writer, p *probe) {
+			if !p.expiration.IsZero() {
+				fmt.Fprintf(w, "dunce_probe_rrsig_expiration_seconds{%s} %g\n", p.labels, p.expiration.Sub(now).Seconds())
+			}
+		}},
+	}
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+		for _, p := range probes {
+			p.mu.Lock()
+			if p.ran {
+				m.write(w, p)
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProbeConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string // a part of the error, empty for none
+	}{
+		{"good", "interval: 1m\nprobes:\n  - name: www.example.com\n    server: 192.0.2.53\n    dnssec: true\n", ""},
+		{"empty", "", "no probes"},
+		{"misspelt probe key", "probes:\n  - name: www.example.com\n    sever: 192.0.2.53\n", "sever"},
+		{"misspelt top level key", "intervals: 1m\nprobes:\n  - name: www.example.com\n", "intervals"},
+		{"no name", "probes:\n  - type: A\n", "no name"},
+		{"negative interval", "probes:\n  - name: www.example.com\n    interval: -1s\n", "interval"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "probes.yaml")
+		if err := os.WriteFile(path, []byte(tt.config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readProbeConfig(path)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got %v, want an error about %s", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestWriteProbeMetrics(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "probes.yaml")
+	config := "probes:\n  - name: www.example.com\n    server: 192.0.2.53\n  - name: example.com\n    type: SOA\n"
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	probes, err := readProbeConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	rrsig := make([]byte, 18)
+	binary.BigEndian.PutUint32(rrsig[8:], uint32(now.Add(time.Hour).Unix()))
+	p := probes.Probes[0]
+	p.record(&DNSMessage{Header: DNSHeader{QR: 1, RCODE: RcodeServerFailure}}, 250*time.Millisecond, nil)
+	p.record(nil, 0, os.ErrDeadlineExceeded)
+	p.record(&DNSMessage{Header: DNSHeader{QR: 1}, Answers: []DNSResourceRecord{
+		testRR(t, "www.example.com.", TypeA, "192.0.2.1"),
+		{NAME: "www.example.com.", TYPE: TypeRRSIG, CLASS: ClassINET, RDATA: rrsig},
+	}}, time.Millisecond, nil)
+
+	var buf bytes.Buffer
+	writeProbeMetrics(&buf, probes.Probes, now)
+
+	// the second probe hasn't run, so it has no samples
+	labels := `name="www.example.com",type="A",server="192.0.2.53"`
+	want := strings.ReplaceAll(`# HELP dunce_probe_success Whether the last probe got a NOERROR response.
+# TYPE dunce_probe_success gauge
+dunce_probe_success{LABELS} 1
+# HELP dunce_probe_rcode Response code of the last response.
+# TYPE dunce_probe_rcode gauge
+dunce_probe_rcode{LABELS} 0
+# HELP dunce_probe_responses_total Responses by response code.
+# TYPE dunce_probe_responses_total counter
+dunce_probe_responses_total{LABELS,rcode="NOERROR"} 1
+dunce_probe_responses_total{LABELS,rcode="SERVFAIL"} 1
+# HELP dunce_probe_runs_total Probes run.
+# TYPE dunce_probe_runs_total counter
+dunce_probe_runs_total{LABELS} 3
+# HELP dunce_probe_failures_total Probes that got no response or an error response code.
+# TYPE dunce_probe_failures_total counter
+dunce_probe_failures_total{LABELS} 2
+# HELP dunce_probe_duration_seconds Time from sending the query to decoding the response.
+# TYPE dunce_probe_duration_seconds histogram
+dunce_probe_duration_seconds_bucket{LABELS,le="0.001"} 1
+dunce_probe_duration_seconds_bucket{LABELS,le="0.0025"} 1
+dunce_probe_duration_seconds_bucket{LABELS,le="0.005"} 1
+dunce_probe_duration_seconds_bucket{LABELS,le="0.01"} 1
+dunce_probe_duration_seconds_bucket{LABELS,le="0.025"} 1
+dunce_probe_duration_seconds_bucket{LABELS,le="0.05"} 1
+dunce_probe_duration_seconds_bucket{LABELS,le="0.1"} 1
+dunce_probe_duration_seconds_bucket{LABELS,le="0.25"} 2
+dunce_probe_duration_seconds_bucket{LABELS,le="0.5"} 2
+dunce_probe_duration_seconds_bucket{LABELS,le="1"} 2
+dunce_probe_duration_seconds_bucket{LABELS,le="2.5"} 2
+dunce_probe_duration_seconds_bucket{LABELS,le="5"} 2
+dunce_probe_duration_seconds_bucket{LABELS,le="+Inf"} 2
+dunce_probe_duration_seconds_sum{LABELS} 0.251
+dunce_probe_duration_seconds_count{LABELS} 2
+# HELP dunce_probe_answer_count Records in the answer section of the last response.
+# TYPE dunce_probe_answer_count gauge
+dunce_probe_answer_count{LABELS} 2
+# HELP dunce_probe_rrsig_expiration_seconds Seconds until the first RRSIG in the last answer expires.
+# TYPE dunce_probe_rrsig_expiration_seconds gauge
+dunce_probe_rrsig_expiration_seconds{LABELS} 3600
+`, "LABELS", labels)
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// and whatever the samples, the buckets are cumulative and the last is
+	// the count
+	var last, inf, count uint64
+	for _, line := range strings.Split(buf.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		n, _ := strconv.ParseUint(fields[1], 10, 64)
+		switch {
+		case strings.HasPrefix(line, "dunce_probe_duration_seconds_bucket") && strings.Contains(line, `le="+Inf"`):
+			inf = n
+		case strings.HasPrefix(line, "dunce_probe_duration_seconds_bucket"):
+			if n < last {
+				t.Errorf("bucket went down: %s", line)
+			}
+			last = n
+		case strings.HasPrefix(line, "dunce_probe_duration_seconds_count"):
+			count = n
+		}
+	}
+	if inf < last || inf != count {
+		t.Errorf("+Inf bucket is %d, last bucket %d and count %d", inf, last, count)
+	}
+}
+
+func TestProbeMainBadClient(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "probes.yaml")
+	if err := os.WriteFile(path, []byte("probes:\n  - name: www.example.com\n    server: 192.0.2.53\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// fails before it would ever get to listening
+	err := probeMain([]string{"-config", path, "-transport", "quic", "-listen", "127.0.0.1:0"})
+	if err == nil || !strings.Contains(err.Error(), "probe www.example.com A @192.0.2.53") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// tcp clients get this long between queries before we hang up
+	recursorIdleTimeout = 10 * time.Second
+
+	// the biggest udp response for clients that don't use EDNS
+	minUDPSize = 512
+)
+
+// recursor answers queries from clients with its Resolver.
+type recursor struct {
+	resolver *Resolver
+	allow    []*net.IPNet // clients to answer, everyone if empty
+	nsid     []byte       // sent to clients that ask for it, if set
+	verbose  bool
+
+	// a slot for each query being answered, so a flood of queries can't
+	// have us resolving without limit
+	inflight chan struct{}
+}
+
+func recursorMain(args []string) error {
+	flags := flag.NewFlagSet("recursor", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:53", "comma separated addresses to answer queries on, over udp and tcp")
+	qmin := flags.Bool("qmin", true, "send each nameserver only as much of the name as it needs (RFC 9156)")
+	dnssec := flags.Bool("dnssec", false, "validate answers with DNSSEC and answer SERVFAIL when they fail")
+	anchors := flags.String("trust-anchor", "", "comma separated root DS records to validate from, instead of the root's own")
+	roots := flags.String("roots", "", "comma separated root server addresses to start from, instead of the real roots")
+	port := flags.String("port", "53", "port to query nameservers on")
+	timeout := flags.Duration("timeout", 2*time.Second, "how long to wait for each nameserver")
+	allow := flags.String("allow", "", "comma separated networks to answer queries from, instead of everyone")
+	nsid := flags.String("nsid", "", "identify this instance with NSID (RFC 5001) to clients that ask")
+	status := flags.String("status", "", "address to serve nameserver stats on at /status, if set")
+	maxInflight := flags.Int("max-inflight", 500, "most queries to answer at once, beyond which udp queries get dropped")
+	verbose := flags.Bool("v", false, "log every query")
+	flags.Parse(args)
+
+	resolver := &Resolver{Port: *port, Timeout: *timeout, Minimise: *qmin, Validate: *dnssec}
+	if *roots != "" {
+		resolver.Roots = strings.Split(*roots, ",")
+	}
+	if *anchors != "" {
+		for _, anchor := range strings.Split(*anchors, ",") {
+			ds, err := parseDS(".", anchor)
+			if err != nil {
+				return err
+			}
+			resolver.Anchors = append(resolver.Anchors, ds)
+		}
+	}
+	if *maxInflight < 1 {
+		return errors.New("-max-inflight must be at least 1")
+	}
+	s := &recursor{resolver: resolver, nsid: []byte(*nsid), verbose: *verbose, inflight: make(chan struct{}, *maxInflight)}
+	if *allow != "" {
+		for _, cidr := range strings.Split(*allow, ",") {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("bad network '%s' in -allow", cidr)
+			}
+			s.allow = append(s.allow, network)
+		}
+	}
+
+	// each address gets a udp and a tcp listener, so listening on both an
+	// IPv4 and an IPv6 address serves both families
+	addrs := strings.Split(*listen, ",")
+	errs := make(chan error, 2*len(addrs)+1)
+	for _, addr := range addrs {
+		udp, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return fmt.Errorf("unable to listen: %w", err)
+		}
+		defer udp.Close()
+		tcp, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("unable to listen: %w", err)
+		}
+		defer tcp.Close()
+
+		log.Printf("answering queries on %s", addr)
+		go func() { errs <- s.serveUDP(udp) }()
+		go func() { errs <- s.serveTCP(tcp) }()
+	}
+	if *status != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			writeServerStats(w, resolver.ServerStats(), time.Now())
+		})
+		log.Printf("serving nameserver stats on %s/status", *status)
+		go func() { errs <- http.ListenAndServe(*status, mux) }()
+	}
+	return <-errs
+}
+
+func (s *recursor) serveUDP(conn net.PacketConn) error {
+	for {
+		buf := make([]byte, 65535)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return fmt.Errorf("error reading query from network: %w", err)
+		}
+		select {
+		case s.inflight <- struct{}{}:
+		default:
+			// too busy to take on another, so drop it and let the client
+			// retry, rather than fall further behind
+			if s.verbose {
+				log.Printf("%s: dropped query, %d already in flight", addr, cap(s.inflight))
+			}
+			continue
+		}
+		go func() {
+			defer func() { <-s.inflight }()
+			if resp := s.answer(buf[:n], addr, true); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *recursor) serveTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return fmt.Errorf("error accepting connection: %w", err)
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers queries on a tcp connection one at a time, until the
+// client hangs up or goes quiet.
+func (s *recursor) serveConn(conn net.Conn) {
+	defer conn.Close()
+	length := make([]byte, 2)
+	for {
+		conn.SetDeadline(time.Now().Add(recursorIdleTimeout))
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		// a tcp client can wait for a slot, since it's only got the one
+		// query outstanding
+		s.inflight <- struct{}{}
+		resp := s.answer(query, conn.RemoteAddr(), false)
+		<-s.inflight
+		if resp == nil {
+			return
+		}
+		conn.SetDeadline(time.Now().Add(recursorIdleTimeout))
+		packet := binary.BigEndian.AppendUint16(make([]byte, 0, len(resp)+2), uint16(len(resp)))
+		if _, err := conn.Write(append(packet, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// answer builds the packed response to a packed query, or returns nil for
+// anything not worth answering.
+func (s *recursor) answer(buf []byte, client net.Addr, udp bool) []byte {
+	start := time.Now()
+	query := &DNSMessage{}
+	if err := query.Unpack(buf); err != nil {
+		// answer FORMERR if there's enough of a header to answer
+		if query.Header.Unpack(buf) != nil || query.Header.QR == 1 {
+			return nil
+		}
+		resp := &DNSMessage{Header: DNSHeader{ID: query.Header.ID, QR: 1, OPCODE: query.Header.OPCODE, RCODE: RcodeFormatError}}
+		packed, _ := resp.Pack()
+		return packed
+	}
+	if query.Header.QR == 1 {
+		return nil
+	}
+
+	resp := &DNSMessage{
+		Header: DNSHeader{
+			ID:     query.Header.ID,
+			QR:     1,
+			OPCODE: query.Header.OPCODE,
+			RD:     query.Header.RD,
+			RA:     1,
+			CD:     query.Header.CD,
+		},
+		Questions: query.Questions,
+	}
+	opt := query.OPT()
+	dnssecOK := opt != nil && opt.TTL&(1<<15) != 0
+	rcode := RcodeSuccess
+	var ede *ExtendedError
+	switch {
+	case !s.allowed(client):
+		rcode = RcodeRefused
+		ede = &ExtendedError{InfoCode: EDEProhibited}
+	case query.Header.OPCODE != 0:
+		rcode = RcodeNotImplemented
+		ede = &ExtendedError{InfoCode: EDENotSupported}
+	case len(query.Questions) != 1:
+		rcode = RcodeFormatError
+	case opt != nil && ednsVersion(opt) != 0:
+		rcode = RcodeBadVersion
+	case query.Header.RD == 0:
+		// we've nothing to answer from but recursion
+		rcode = RcodeRefused
+		ede = &ExtendedError{InfoCode: EDENotAuthoritative}
+	case query.Questions[0].QCLASS != ClassINET:
+		rcode = RcodeRefused
+		ede = &ExtendedError{InfoCode: EDENotSupported, ExtraText: "only class IN is supported"}
+	case query.Questions[0].QTYPE == TypeOPT, query.Questions[0].QTYPE == TypeAXFR, query.Questions[0].QTYPE == TypeIXFR:
+		rcode = RcodeNotImplemented
+		ede = &ExtendedError{InfoCode: EDENotSupported}
+	default:
+		q := query.Questions[0]
+		result, err := s.resolver.resolve(q.QNAME, q.QTYPE, query.Header.CD == 0)
+		if err != nil {
+			rcode = RcodeServerFailure
+			ede = resolveErrorEDE(err)
+			if s.verbose {
+				log.Printf("%s %s %s: %v", client, q.QNAME, typeString(q.QTYPE), err)
+			}
+			break
+		}
+		rcode = result.Rcode()
+		if rcode != RcodeSuccess && rcode != RcodeNameError {
+			// the error is the nameservers', and ours is that we couldn't
+			// get an answer out of them
+			ede = &ExtendedError{InfoCode: EDENoReachableAuthority, ExtraText: "nameservers answered " + rcodeString(rcode)}
+			rcode = RcodeServerFailure
+			break
+		}
+		resp.Answers = result.Answers
+		resp.Authorities = result.Authorities
+		if !dnssecOK {
+			resp.Answers = withoutDNSSEC(resp.Answers, q.QTYPE)
+			resp.Authorities = withoutDNSSEC(resp.Authorities, q.QTYPE)
+		}
+		// AD only goes to clients that showed they understand it
+		if result.Header.AD == 1 && (dnssecOK || query.Header.AD == 1) {
+			resp.Header.AD = 1
+		}
+	}
+
+	resp.Header.RCODE = rcode & 0xf
+	size := minUDPSize
+	if opt != nil {
+		if int(opt.CLASS) > size {
+			size = int(opt.CLASS)
+		}
+		// anything bigger than we advertise ourselves is better off over
+		// tcp than as fragmented udp
+		if size > DefaultUDPSize {
+			size = DefaultUDPSize
+		}
+		ttl := uint32(rcode>>4) << 24
+		if dnssecOK {
+			ttl |= 1 << 15
+		}
+		rdata := []byte{}
+		wantsNSID := false
+		ednsOptions(opt, func(code uint16, data []byte) {
+			wantsNSID = wantsNSID || code == OptionNSID
+		})
+		if wantsNSID && len(s.nsid) > 0 {
+			rdata = appendEDNSOption(rdata, OptionNSID, s.nsid)
+		}
+		if ede != nil {
+			rdata = appendEDE(rdata, *ede)
+		}
+		resp.Additionals = append(resp.Additionals, DNSResourceRecord{NAME: ".", TYPE: TypeOPT, CLASS: DefaultUDPSize, TTL: ttl, RDATA: rdata})
+	}
+	packed, err := resp.Pack()
+	if err == nil && udp && len(packed) > size {
+		// too big for the client's buffer, so it has to ask again over tcp
+		resp.Header.TC = 1
+		resp.Answers, resp.Authorities = nil, nil
+		packed, err = resp.Pack()
+	}
+	if err != nil {
+		log.Printf("unable to pack response to %s: %v", client, err)
+		return nil
+	}
+
+	if s.verbose && len(query.Questions) == 1 {
+		q := query.Questions[0]
+		log.Printf("%s %s %s %s %d answers %s", client, q.QNAME, typeString(q.QTYPE), rcodeString(rcode),
+			len(resp.Answers), time.Since(start).Round(time.Millisecond))
+	}
+	return packed
+}
+
+func (s *recursor) allowed(client net.Addr) bool {
+	if len(s.allow) == 0 {
+		return true
+	}
+	var ip net.IP
+	switch addr := client.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	}
+	for _, network := range s.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveErrorEDE picks the Extended DNS Error that explains why resolving
+// failed. Beyond validation failures, the text is fixed: the error itself
+// names the nameservers we tried and how we got to them, which is for our
+// log and not for clients.
+func resolveErrorEDE(err error) *ExtendedError {
+	var invalid *validationError
+	switch {
+	case errors.As(err, &invalid):
+		return &ExtendedError{InfoCode: invalid.code, ExtraText: invalid.msg}
+	case errors.Is(err, errLame):
+		return &ExtendedError{InfoCode: EDENoReachableAuthority, ExtraText: "no nameserver gave a usable answer"}
+	case errors.Is(err, errUnreachable):
+		return &ExtendedError{InfoCode: EDENoReachableAuthority, ExtraText: "no nameserver answered"}
+	}
+	return &ExtendedError{InfoCode: EDEOther, ExtraText: "unable to resolve"}
+}
+
+// writeServerStats writes a line for each nameserver address, fastest first.
+func writeServerStats(w io.Writer, stats []ServerStats, now time.Time) {
+	fmt.Fprintf(w, "%-40s %10s %10s %10s  %s\n", "address", "srtt", "queries", "failures", "backoff")
+	for _, s := range stats {
+		srtt, backoff := "-", "-"
+		if s.SRTT != 0 {
+			srtt = fmt.Sprintf("%.1fms", float64(s.SRTT.Microseconds())/1000)
+		}
+		if now.Before(s.Backoff) {
+			backoff = s.Backoff.Sub(now).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%-40s %10s %10d %10d  %s\n", s.Addr, srtt, s.Queries, s.Failures, backoff)
+	}
+}
+
+// withoutDNSSEC drops the signatures and denial records clients that didn't
+// set DO have no use for, unless they asked for them by type.
+func withoutDNSSEC(records []DNSResourceRecord, qtype uint16) []DNSResourceRecord {
+	var kept []DNSResourceRecord
+	for _, rr := range records {
+		switch rr.TYPE {
+		case TypeRRSIG, TypeNSEC, TypeNSEC3:
+			if rr.TYPE != qtype {
+				continue
+			}
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// testRecursor answers for a test. zone with a small RRset, one too big for
+// udp without EDNS, and one too big for udp at all.
+func testRecursor(t *testing.T) *recursor {
+	records := []DNSResourceRecord{testRR(t, "www.test.", TypeA, "192.0.2.1")}
+	for i := 0; i < 40; i++ {
+		records = append(records, testRR(t, "big.test.", TypeA, fmt.Sprintf("192.0.2.%d", i+1)))
+	}
+	for i := 0; i < 80; i++ {
+		records = append(records, testRR(t, "huge.test.", TypeA, fmt.Sprintf("192.0.2.%d", i+1)))
+	}
+	return &recursor{resolver: testHierarchy(t, records...)}
+}
+
+// ask sends the recursor a query and unpacks its response.
+func (s *recursor) ask(t *testing.T, query []byte, udp bool) *DNSMessage {
+	t.Helper()
+	packed := s.answer(query, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}, udp)
+	if packed == nil {
+		return nil
+	}
+	resp := &DNSMessage{}
+	if err := resp.Unpack(packed); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestRecursorAnswer(t *testing.T) {
+	s := testRecursor(t)
+	tests := []struct {
+		name    string
+		qname   string
+		opts    QueryOptions
+		udp     bool
+		rcode   uint16
+		tc      bool
+		answers int
+	}{
+		{"udp", "www.test.", QueryOptions{}, true, RcodeSuccess, false, 1},
+		{"nxdomain", "missing.test.", QueryOptions{}, true, RcodeNameError, false, 0},
+		{"too big for udp", "big.test.", QueryOptions{}, true, RcodeSuccess, true, 0},
+		{"big with edns", "big.test.", QueryOptions{EDNS: true}, true, RcodeSuccess, false, 40},
+		{"big over tcp", "big.test.", QueryOptions{}, false, RcodeSuccess, false, 40},
+		{"huge with a big buffer", "huge.test.", QueryOptions{EDNS: true, UDPSize: 4096}, true, RcodeSuccess, true, 0},
+		{"huge over tcp", "huge.test.", QueryOptions{EDNS: true, UDPSize: 4096}, false, RcodeSuccess, false, 80},
+		{"no recursion", "www.test.", QueryOptions{NoRecursion: true}, true, RcodeRefused, false, 0},
+		{"edns version 1", "www.test.", QueryOptions{EDNS: true, EDNSVersion: 1}, true, RcodeBadVersion, false, 0},
+	}
+	for _, tt := range tests {
+		query, err := newQuery(tt.qname, TypeA, tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := s.ask(t, query, tt.udp)
+		if resp == nil {
+			t.Errorf("%s: no response", tt.name)
+			continue
+		}
+		if resp.Rcode() != tt.rcode || (resp.Header.TC == 1) != tt.tc || len(resp.Answers) != tt.answers {
+			t.Errorf("%s got:\n%s", tt.name, resp)
+		}
+		if (resp.OPT() != nil) != tt.opts.EDNS {
+			t.Errorf("%s: OPT in the response is %v", tt.name, resp.OPT())
+		}
+	}
+}
+
+func TestRecursorMalformed(t *testing.T) {
+	s := testRecursor(t)
+
+	// a question count with no question after it
+	header := DNSHeader{ID: 0xbeef, RD: 1, QDCOUNT: 1}
+	query, _ := header.Pack()
+	resp := s.ask(t, query, true)
+	if resp == nil || resp.Header.ID != 0xbeef || resp.Rcode() != RcodeFormatError {
+		t.Errorf("truncated question got:\n%s", resp)
+	}
+
+	two := &DNSMessage{
+		Header: DNSHeader{ID: 1, RD: 1},
+		Questions: []DNSQuestion{
+			{QNAME: "www.test.", QTYPE: TypeA, QCLASS: ClassINET},
+			{QNAME: "big.test.", QTYPE: TypeA, QCLASS: ClassINET},
+		},
+	}
+	query, _ = two.Pack()
+	if resp := s.ask(t, query, true); resp == nil || resp.Rcode() != RcodeFormatError {
+		t.Errorf("two questions got:\n%s", resp)
+	}
+
+	// responses and less than a header don't get answered at all
+	header = DNSHeader{ID: 2, QR: 1}
+	query, _ = header.Pack()
+	if resp := s.ask(t, query, true); resp != nil {
+		t.Errorf("response got:\n%s", resp)
+	}
+	if resp := s.ask(t, []byte{0, 1, 2}, true); resp != nil {
+		t.Errorf("short query got:\n%s", resp)
+	}
+}
+
+func TestRecursorAllow(t *testing.T) {
+	s := testRecursor(t)
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	s.allow = []*net.IPNet{network}
+	query, _ := newQuery("www.test.", TypeA, QueryOptions{EDNS: true})
+	resp := s.ask(t, query, true)
+	if resp == nil || resp.Rcode() != RcodeRefused {
+		t.Fatalf("client outside -allow got:\n%s", resp)
+	}
+	if ede := resp.ExtendedErrors(); len(ede) != 1 || ede[0].InfoCode != EDEProhibited {
+		t.Errorf("client outside -allow got EDEs %v", ede)
+	}
+}
+
+func TestRecursorDropsWhenBusy(t *testing.T) {
+	s := testRecursor(t)
+	s.inflight = make(chan struct{}, 1)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go s.serveUDP(conn)
+	client, err := NewClient(TransportUDP, conn.LocalAddr().String(), 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// with the only slot taken, the query gets dropped
+	s.inflight <- struct{}{}
+	if msg, err := client.Query("www.test.", TypeA); !isTimeout(err) {
+		t.Fatalf("busy recursor answered %v:\n%s", err, msg)
+	}
+	<-s.inflight
+	msg, err := client.Query("www.test.", TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answers) != 1 {
+		t.Errorf("got:\n%s", msg)
+	}
+}
+
+func TestResolveErrorEDE(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"bogus", fmt.Errorf("unable to validate: %w", &validationError{code: EDESignatureExpired, msg: "RRSIG for www.test. A expired"}),
+			"7 (Signature Expired): RRSIG for www.test. A expired"},
+		{"lame", fmt.Errorf("no nameservers for test. at 192.0.2.1:53 gave a usable answer, last one said %w", errLame),
+			"22 (No Reachable Authority): no nameserver gave a usable answer"},
+		{"unreachable", fmt.Errorf("%w for test.: read udp 192.0.2.1:53: i/o timeout", errUnreachable),
+			"22 (No Reachable Authority): no nameserver answered"},
+		{"anything else", fmt.Errorf("unable to dial 10.1.2.3:53: too many open files"),
+			"0 (Other): unable to resolve"},
+	}
+	for _, tt := range tests {
+		if got := resolveErrorEDE(tt.err).String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRecursorNSID(t *testing.T) {
+	tests := []struct {
+		name   string
+		nsid   string // the recursor's
+		opts   QueryOptions
+		wanted bool // whether the response should carry it
+	}{
+		{"asked", "r1.example", QueryOptions{EDNS: true, NSID: true}, true},
+		{"not asked", "r1.example", QueryOptions{EDNS: true}, false},
+		{"no edns", "r1.example", QueryOptions{}, false},
+		{"none to give", "", QueryOptions{EDNS: true, NSID: true}, false},
+	}
+	for _, tt := range tests {
+		s := testRecursor(t)
+		s.nsid = []byte(tt.nsid)
+		query, err := newQuery("www.test.", TypeA, tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := s.ask(t, query, true)
+		if resp == nil || resp.Rcode() != RcodeSuccess {
+			t.Fatalf("%s got:\n%s", tt.name, resp)
+		}
+		nsid, found := resp.NSID()
+		if found != tt.wanted || (found && string(nsid) != tt.nsid) {
+			t.Errorf("%s: got NSID %q, %v", tt.name, nsid, found)
+		}
+	}
+}
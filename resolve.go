@@ -0,0 +1,984 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// rootHints are the IPv4 and IPv6 addresses of the root servers, a through m.
+var rootHints = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13", "192.203.230.10",
+	"192.5.5.241", "192.112.36.4", "198.97.190.53", "192.36.148.17", "192.58.128.30",
+	"193.0.14.129", "199.7.83.42", "202.12.27.33",
+	"2001:503:ba3e::2:30", "2801:1b8:10::b", "2001:500:2::c", "2001:500:2d::d", "2001:500:a8::e",
+	"2001:500:2f::f", "2001:500:12::d0d", "2001:500:1::53", "2001:7fe::53", "2001:503:c27::2:30",
+	"2001:7fd::1", "2001:500:9f::42", "2001:dc3::35",
+}
+
+const (
+	// maxResolveQueries bounds the queries sent for one name, including the
+	// ones for following CNAMEs and finding nameserver addresses.
+	maxResolveQueries = 50
+
+	// maxResolveTime bounds how long one name can take to resolve.
+	maxResolveTime = 10 * time.Second
+
+	// maxResolveDepth bounds how deep lookups of nameserver addresses nest.
+	maxResolveDepth = 3
+
+	// maxChain bounds how many CNAMEs and DNAMEs get followed for one name.
+	maxChain = 8
+
+	// maxMinimise is how many minimised queries get sent for one name
+	// before giving up and revealing the rest of it, so long names can't
+	// cost a query per label (RFC 9156, MAX_MINIMISE_COUNT).
+	maxMinimise = 10
+
+	// infrastructure records get cached for at most this long, whatever
+	// their ttl, and the cache gets swept of expired entries once it has
+	// this many
+	maxInfraTTL     = 24 * time.Hour
+	maxInfraEntries = 10000
+)
+
+// errUnreachable is wrapped by the error for none of a zone's nameservers
+// answering, as opposed to them answering badly.
+var errUnreachable = errors.New("no nameservers answered")
+
+// errLame is wrapped by the error for a server answering for a zone it isn't
+// authoritative for, and for all of a zone's servers doing so.
+var errLame = errors.New("lame delegation")
+
+// Resolver answers queries by starting at the root servers and following
+// referrals, rather than asking a recursive resolver. It caches the
+// nameservers and addresses it learns along the way, and is safe for
+// concurrent use once its fields are set.
+type Resolver struct {
+	Roots   []string // root server addresses, rootHints if empty
+	Port    string   // port to query nameservers on, 53 if empty
+	Timeout time.Duration
+
+	// Minimise sends each nameserver only as much of the name as it needs
+	// to give a referral (RFC 9156), instead of the full name.
+	Minimise bool
+
+	// Validate checks DNSSEC signatures from the root's trust anchors down,
+	// and answers that fail to validate become errors wrapping errBogus.
+	Validate bool
+	Anchors  []DNSResourceRecord // root DS records, rootAnchors if empty
+
+	// Trace, if set, is called with every query sent and what came of it.
+	Trace func(step *ResolveStep)
+
+	mu    sync.Mutex
+	cuts  map[string]*zoneCut
+	addrs map[string]*cachedAddrs
+	stats map[string]*ServerStats
+}
+
+// ResolveStep is one query sent while resolving a name.
+type ResolveStep struct {
+	Depth   int    // 0 for the name being resolved, 1 and up for nameserver addresses
+	Zone    string // the zone the server was asked as a nameserver for
+	Server  string // the nameserver's name, empty for root hints
+	Addr    string
+	Name    string
+	Type    uint16
+	Msg     *DNSMessage
+	Err     error
+	Latency time.Duration
+
+	Referral string // the zone the response delegated to, if it was a referral
+	Note     string // anything unusual about the response
+}
+
+// zoneCut is what we know about a zone from its parent's referral: its
+// nameservers, and when validating, whether it's signed and with what keys.
+type zoneCut struct {
+	name    string
+	servers []string // nameserver names, empty for the root
+	expires time.Time
+
+	insecure bool  // proven unsigned, or below an unsigned zone
+	bogus    error // the delegation itself failed to validate
+	ds       []DNSResourceRecord
+	keys     []DNSResourceRecord // validated DNSKEYs, nil until fetched
+}
+
+type cachedAddrs struct {
+	addrs   []string
+	expires time.Time
+}
+
+// nameserver is a server for a zone, with the addresses we know for it.
+type nameserver struct {
+	name     string
+	addrs    []string
+	resolved bool // whether we've tried to look up addresses without glue
+}
+
+// resolution is the state of resolving one name, which the limits apply to.
+type resolution struct {
+	r        *Resolver
+	validate bool
+	queries  int
+	deadline time.Time
+	active   map[string]bool // lookups in progress, to catch loops
+}
+
+// Resolve follows referrals from the root to an answer for the name, and
+// follows any CNAMEs and DNAMEs to the end of the chain. The answer is
+// returned whatever its rcode, and the error is only for failing to get
+// one. When validating, AD is set on answers that are secure all the way
+// down.
+func (r *Resolver) Resolve(name string, qtype uint16) (*DNSMessage, error) {
+	return r.resolve(name, qtype, r.Validate)
+}
+
+func (r *Resolver) resolve(name string, qtype uint16, validate bool) (*DNSMessage, error) {
+	res := &resolution{
+		r:        r,
+		validate: validate && r.Validate,
+		deadline: time.Now().Add(maxResolveTime),
+		active:   make(map[string]bool),
+	}
+	return res.resolve(canonicalName(name), qtype, 0)
+}
+
+func (res *resolution) resolve(name string, qtype uint16, depth int) (*DNSMessage, error) {
+	key := name + " " + typeString(qtype)
+	if res.active[key] {
+		return nil, fmt.Errorf("loop looking up %s", key)
+	}
+	res.active[key] = true
+	defer delete(res.active, key)
+
+	result := &DNSMessage{
+		Header:    DNSHeader{QR: 1, RD: 1, RA: 1},
+		Questions: []DNSQuestion{{QNAME: name, QTYPE: qtype, QCLASS: ClassINET}},
+	}
+	secure := res.validate
+	target := name
+	seen := map[string]bool{name: true}
+	for {
+		ans, err := res.resolveName(target, qtype, depth)
+		if err != nil {
+			return nil, err
+		}
+		msg, cut := ans.msg, ans.cut
+		keys, err := res.zoneKeys(cut, ans.servers, depth)
+		if err != nil {
+			return nil, err
+		}
+		secure = secure && keys != nil
+		records := inBailiwick(msg.Answers, cut.name)
+
+		// follow the chain as far as this zone's answer goes
+		asked := target
+		found := false
+		for {
+			if rrset := matchRecords(records, target, qtype); len(rrset) > 0 {
+				if err := res.check(rrset, msg, keys, cut.name); err != nil {
+					return nil, err
+				}
+				result.Answers = append(result.Answers, withSignatures(rrset, records)...)
+				found = true
+				break
+			}
+
+			var next string
+			if dname := findDNAME(records, target); dname != nil && qtype != TypeDNAME {
+				if err := res.check([]DNSResourceRecord{*dname}, msg, keys, cut.name); err != nil {
+					return nil, err
+				}
+				cname, err := synthesizeCNAME(dname, target)
+				if err != nil {
+					return nil, err
+				}
+				result.Answers = append(result.Answers, withSignatures([]DNSResourceRecord{*dname}, records)...)
+				result.Answers = append(result.Answers, cname)
+				next = cname.Data
+			} else if cname := matchRecords(records, target, TypeCNAME); len(cname) > 0 && qtype != TypeCNAME {
+				if err := res.check(cname, msg, keys, cut.name); err != nil {
+					return nil, err
+				}
+				result.Answers = append(result.Answers, withSignatures(cname[:1], records)...)
+				next = canonicalName(cname[0].Data)
+			} else {
+				break
+			}
+
+			if seen[next] {
+				return nil, fmt.Errorf("CNAME loop at %s", next)
+			}
+			if len(seen) > maxChain {
+				return nil, fmt.Errorf("more than %d CNAMEs following %s", maxChain, name)
+			}
+			seen[next] = true
+			target = next
+		}
+		if found {
+			break
+		}
+
+		// the response only speaks for the name it was asked about, so a
+		// CNAME target it has nothing for still needs looking up
+		if target != asked {
+			continue
+		}
+		result.Header.RCODE = msg.Rcode() & 0xf
+		result.Authorities = inBailiwick(msg.Authorities, cut.name)
+		if keys != nil {
+			d := newDenial(msg.Authorities, keys, cut.name, time.Now())
+			if msg.Rcode() == RcodeNameError {
+				err = d.nxDomain(target)
+			} else {
+				err = d.noData(target, qtype)
+			}
+			if err != nil && res.validate {
+				return nil, err
+			}
+		}
+		break
+	}
+	if secure {
+		result.Header.AD = 1
+	}
+	return result, nil
+}
+
+// authAnswer is a response from a zone's own servers, past any referrals.
+type authAnswer struct {
+	msg     *DNSMessage
+	cut     *zoneCut
+	servers []*nameserver
+}
+
+// resolveName follows referrals from the closest zone cut we know of down
+// to the servers that have the answer for the name.
+func (res *resolution) resolveName(name string, qtype uint16, depth int) (*authAnswer, error) {
+	r := res.r
+	labels, err := splitName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	cut := r.closestCut(name)
+	servers := r.serversFor(cut)
+	minimise := r.Minimise
+	revealed, minimised := 0, 0
+	for {
+		qname, qt := name, qtype
+		if minimise && minimised < maxMinimise {
+			n := labelCount(cut.name) + 1
+			if n <= revealed {
+				n = revealed + 1
+			}
+			if n < len(labels) {
+				// RFC 9156 recommends A over NS, since some servers
+				// mishandle NS queries below a zone cut
+				qname, qt = joinLabels(labels[len(labels)-n:]), TypeA
+				revealed = n
+				minimised++
+			}
+		}
+
+		step, err := res.ask(servers, cut.name, qname, qt, depth)
+		if err != nil {
+			return nil, err
+		}
+		msg := step.Msg
+		rcode := msg.Rcode()
+
+		if child := referral(msg, cut.name, qname); child != "" {
+			step.Referral = child
+			r.trace(step)
+			if cut, err = res.delegate(cut, servers, child, msg, depth); err != nil {
+				return nil, err
+			}
+			servers = r.serversFor(cut)
+			continue
+		}
+
+		if qname != name {
+			if rcode != RcodeSuccess {
+				// an NXDOMAIN here should mean nothing exists below the
+				// name either (RFC 8020), but some servers say that for
+				// empty non-terminals, and some choke on the A query, so
+				// ask again with the full name to find out
+				step.Note = fmt.Sprintf("%s for a minimised name, retrying with the full name", rcodeString(rcode))
+				r.trace(step)
+				minimise = false
+				continue
+			}
+			// the name exists, or at least has names below it
+			r.trace(step)
+			continue
+		}
+		r.trace(step)
+
+		// a server for both a zone and its child answers from the child
+		// without a referral, and when validating we need to know
+		if r.Validate {
+			if child := answeringZone(msg, cut.name, name); child != cut.name {
+				if cut, err = res.descend(cut, servers, child, depth); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return &authAnswer{msg: msg, cut: cut, servers: servers}, nil
+	}
+}
+
+func (r *Resolver) trace(step *ResolveStep) {
+	if r.Trace != nil {
+		r.Trace(step)
+	}
+}
+
+// ask sends the query to the servers' addresses, best first, until one
+// gives a usable answer. Each address gets a short while to answer before
+// the next one is tried alongside it, and the first usable answer wins. If
+// none of them give one but some answered, the last answer is returned.
+func (res *resolution) ask(servers []*nameserver, zone, name string, qtype uint16, depth int) (*ResolveStep, error) {
+	r := res.r
+	var last *ResolveStep
+	var limit, lameErr error
+	for pending := servers; len(pending) > 0 && limit == nil; {
+		// servers we have addresses for go first, and the others only get
+		// looked up, one at a time, if none of those answer
+		var ready, later []*nameserver
+		for _, ns := range pending {
+			if ns.resolved {
+				ready = append(ready, ns)
+			} else {
+				later = append(later, ns)
+			}
+		}
+		if len(ready) == 0 {
+			ns := later[0]
+			ns.resolved = true
+			ns.addrs = res.lookupNameserver(ns.name, zone, depth)
+			ready, later = later[:1], later[1:]
+		}
+		pending = later
+
+		targets := r.rank(ready)
+		// queries that lose the race finish in the background, so this has
+		// room for all of them
+		results := make(chan *ResolveStep, len(targets))
+		launch := func(target serverAddr) bool {
+			if res.queries >= maxResolveQueries {
+				limit = fmt.Errorf("gave up on %s after %d queries", name, res.queries)
+				return false
+			}
+			if time.Now().After(res.deadline) {
+				limit = fmt.Errorf("gave up on %s after %s", name, maxResolveTime)
+				return false
+			}
+			res.queries++
+			step := &ResolveStep{Depth: depth, Zone: zone, Server: target.ns.name, Addr: target.addr, Name: name, Type: qtype}
+			go func() {
+				r.query(step)
+				results <- step
+			}()
+			return true
+		}
+
+		waiting := 0
+		for next := 0; (next < len(targets) && limit == nil) || waiting > 0; {
+			var delay <-chan time.Time
+			if next < len(targets) && limit == nil {
+				if waiting == 0 {
+					// nothing left to wait for, so go straight to the next
+					if launch(targets[next]) {
+						waiting++
+					}
+					next++
+					continue
+				}
+				delay = time.After(nextAttemptDelay(targets[next-1].srtt))
+			}
+
+			select {
+			case <-delay:
+				if launch(targets[next]) {
+					waiting++
+				}
+				next++
+			case step := <-results:
+				waiting--
+				if step.Err != nil {
+					if errors.Is(step.Err, errLame) {
+						lameErr = step.Err
+					}
+					r.trace(step)
+					continue
+				}
+				switch step.Msg.Rcode() {
+				case RcodeSuccess, RcodeNameError:
+					return step, nil
+				}
+				if last != nil {
+					r.trace(last)
+				}
+				last = step
+			}
+		}
+	}
+	if last != nil {
+		return last, nil
+	}
+	if limit != nil {
+		return nil, limit
+	}
+	if lameErr != nil {
+		return nil, fmt.Errorf("no nameservers for %s gave a usable answer, last one said %w", zone, lameErr)
+	}
+	return nil, fmt.Errorf("%w for %s", errUnreachable, zone)
+}
+
+// query sends the step's query to its address and fills in what came back.
+func (r *Resolver) query(step *ResolveStep) {
+	port := r.Port
+	if port == "" {
+		port = "53"
+	}
+	client, err := NewClient(TransportUDP, withDefaultPort(step.Addr, port), r.Timeout)
+	if err != nil {
+		step.Err = err
+		return
+	}
+	defer client.Close()
+	client.Options = QueryOptions{NoRecursion: true, EDNS: true, DNSSECOK: r.Validate}
+	start := time.Now()
+	step.Msg, step.Err = client.Query(step.Name, step.Type)
+	step.Latency = time.Since(start)
+
+	if step.Err == nil && !answersQuestion(step.Msg, step.Name, step.Type) {
+		step.Err = errors.New("response is for a different question")
+	}
+	if step.Err == nil {
+		if why := lame(step.Msg, step.Zone, step.Name); why != "" {
+			step.Err = fmt.Errorf("%w: %s", errLame, why)
+		}
+	}
+	r.observe(step)
+}
+
+func answersQuestion(msg *DNSMessage, name string, qtype uint16) bool {
+	if len(msg.Questions) != 1 {
+		// some servers leave the question out of error responses
+		return len(msg.Questions) == 0 && msg.Rcode() != RcodeSuccess
+	}
+	q := msg.Questions[0]
+	return canonicalName(q.QNAME) == canonicalName(name) && q.QTYPE == qtype && q.QCLASS == ClassINET
+}
+
+// lookupNameserver finds the addresses of a nameserver that came without
+// glue, by resolving its name from the root.
+func (res *resolution) lookupNameserver(name, zone string, depth int) []string {
+	r := res.r
+	if depth >= maxResolveDepth {
+		r.trace(&ResolveStep{Depth: depth, Zone: zone, Server: name, Err: errors.New("too many nested nameserver lookups")})
+		return nil
+	}
+	if isSubdomain(name, zone) {
+		// a nameserver inside the zone it serves needs glue to be found
+		r.trace(&ResolveStep{Depth: depth, Zone: zone, Server: name, Err: errors.New("no glue for a nameserver inside its own zone")})
+		return nil
+	}
+	var addrs []string
+	ttl := maxInfraTTL
+	for _, qtype := range []uint16{TypeA, TypeAAAA} {
+		msg, err := res.resolve(name, qtype, depth+1)
+		if err != nil {
+			r.trace(&ResolveStep{Depth: depth + 1, Zone: zone, Server: name, Err: err})
+			continue
+		}
+		for _, rr := range msg.Answers {
+			// nameserver names shouldn't be CNAMEs, but plenty are, so take
+			// the addresses from the end of any chain
+			if rr.TYPE != qtype {
+				continue
+			}
+			addrs = append(addrs, rr.Data)
+			if t := time.Duration(rr.TTL) * time.Second; t < ttl {
+				ttl = t
+			}
+		}
+	}
+	r.storeAddrs(name, addrs, ttl)
+	return addrs
+}
+
+// delegate follows a referral from the parent to the child zone, caching
+// the child's nameservers and glue, and when validating, checking the DS
+// records or the proof there aren't any.
+func (res *resolution) delegate(parent *zoneCut, servers []*nameserver, child string, msg *DNSMessage, depth int) (*zoneCut, error) {
+	r := res.r
+	cut := &zoneCut{name: child}
+	ttl := maxInfraTTL
+	for _, rr := range msg.Authorities {
+		if rr.TYPE == TypeNS && canonicalName(rr.NAME) == child {
+			cut.servers = append(cut.servers, canonicalName(rr.Data))
+			if t := time.Duration(rr.TTL) * time.Second; t < ttl {
+				ttl = t
+			}
+		}
+	}
+	cut.expires = time.Now().Add(ttl)
+
+	// glue is only trusted for names inside the zone whose servers sent
+	// the referral, since those servers are authoritative for nothing else
+	for _, target := range cut.servers {
+		if !isSubdomain(target, parent.name) {
+			continue
+		}
+		var addrs []string
+		glueTTL := maxInfraTTL
+		for _, rr := range msg.Additionals {
+			if (rr.TYPE == TypeA || rr.TYPE == TypeAAAA) && canonicalName(rr.NAME) == target {
+				addrs = append(addrs, rr.Data)
+				if t := time.Duration(rr.TTL) * time.Second; t < glueTTL {
+					glueTTL = t
+				}
+			}
+		}
+		if len(addrs) > 0 {
+			r.storeAddrs(target, addrs, glueTTL)
+		}
+	}
+
+	if r.Validate {
+		res.secureDelegation(parent, servers, cut, msg.Authorities, depth)
+	}
+	r.storeCut(cut)
+	return cut, nil
+}
+
+// descend finds the DS records for a child zone that the parent's servers
+// also serve, so they answered from it without a referral. The child isn't
+// cached, since we don't know its nameservers.
+func (res *resolution) descend(parent *zoneCut, servers []*nameserver, child string, depth int) (*zoneCut, error) {
+	cut := &zoneCut{name: child, expires: parent.expires}
+	if parent.insecure || parent.bogus != nil {
+		res.secureDelegation(parent, servers, cut, nil, depth)
+		return cut, nil
+	}
+	step, err := res.ask(servers, parent.name, child, TypeDS, depth)
+	if err != nil {
+		return nil, err
+	}
+	res.r.trace(step)
+	records := append(append([]DNSResourceRecord{}, step.Msg.Answers...), step.Msg.Authorities...)
+	res.secureDelegation(parent, servers, cut, records, depth)
+	return cut, nil
+}
+
+// secureDelegation works out whether the child zone is signed, from the DS
+// records or their denial among the parent's records.
+func (res *resolution) secureDelegation(parent *zoneCut, servers []*nameserver, cut *zoneCut, records []DNSResourceRecord, depth int) {
+	switch {
+	case parent.bogus != nil:
+		cut.bogus = parent.bogus
+		return
+	case parent.insecure:
+		cut.insecure = true
+		return
+	}
+	keys, err := res.zoneKeys(parent, servers, depth)
+	if err != nil {
+		cut.bogus = err
+		return
+	}
+
+	var ds []DNSResourceRecord
+	for _, rr := range records {
+		if rr.TYPE == TypeDS && canonicalName(rr.NAME) == cut.name {
+			ds = append(ds, rr)
+		}
+	}
+	now := time.Now()
+	if len(ds) == 0 {
+		if err := newDenial(records, keys, parent.name, now).noDS(cut.name); err != nil {
+			cut.bogus = err
+		} else {
+			cut.insecure = true
+		}
+		return
+	}
+	if _, err := verifyRRset(ds, records, keys, parent.name, now); err != nil {
+		cut.bogus = err
+		return
+	}
+	for i := range ds {
+		if supportedDS(&ds[i]) {
+			cut.ds = append(cut.ds, ds[i])
+		}
+	}
+	if len(cut.ds) == 0 {
+		cut.insecure = true
+	}
+}
+
+// zoneKeys returns the zone's validated DNSKEYs, fetching them if need be,
+// or nil if the zone is unsigned or we aren't validating.
+func (res *resolution) zoneKeys(cut *zoneCut, servers []*nameserver, depth int) ([]DNSResourceRecord, error) {
+	r := res.r
+	if !r.Validate {
+		return nil, nil
+	}
+	r.mu.Lock()
+	keys, insecure, bogusErr := cut.keys, cut.insecure, cut.bogus
+	r.mu.Unlock()
+	switch {
+	case bogusErr != nil:
+		if res.validate {
+			return nil, bogusErr
+		}
+		return nil, nil
+	case insecure:
+		return nil, nil
+	case keys != nil:
+		return keys, nil
+	}
+
+	step, err := res.ask(servers, cut.name, cut.name, TypeDNSKEY, depth)
+	if err != nil {
+		return nil, err
+	}
+	r.trace(step)
+	var dnskeys []DNSResourceRecord
+	for _, rr := range step.Msg.Answers {
+		if rr.TYPE == TypeDNSKEY && canonicalName(rr.NAME) == cut.name {
+			dnskeys = append(dnskeys, rr)
+		}
+	}
+
+	// the DS records vouch for a key, and that key vouches for the rest
+	now := time.Now()
+	for i := range cut.ds {
+		for j := range dnskeys {
+			if !dsMatches(&cut.ds[i], &dnskeys[j]) {
+				continue
+			}
+			if _, err := verifyRRset(dnskeys, step.Msg.Answers, dnskeys[j:j+1], cut.name, now); err != nil {
+				continue
+			}
+			r.mu.Lock()
+			cut.keys = dnskeys
+			r.mu.Unlock()
+			return dnskeys, nil
+		}
+	}
+	err = bogus(EDEDNSKEYMissing, "no DNSKEY for %s matches its DS records", cut.name)
+	if res.validate {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// check validates an RRset from a response, if the zone is signed. Records
+// expanded from a wildcard also need proof their name doesn't exist.
+func (res *resolution) check(rrset []DNSResourceRecord, msg *DNSMessage, keys []DNSResourceRecord, zone string) error {
+	if keys == nil {
+		return nil
+	}
+	now := time.Now()
+	sig, err := verifyRRset(rrset, msg.Answers, keys, zone, now)
+	if err == nil {
+		labels, _ := splitName(rrset[0].NAME)
+		if sigLabels := int(sig.RDATA[3]); sigLabels < len(labels) {
+			source := joinLabels(labels[len(labels)-sigLabels:])
+			err = newDenial(msg.Authorities, keys, zone, now).wildcardAnswer(canonicalName(rrset[0].NAME), source)
+		}
+	}
+	if err != nil && res.validate {
+		return err
+	}
+	return nil
+}
+
+// closestCut returns the deepest zone cut we have cached above the name,
+// falling back to the root.
+func (r *Resolver) closestCut(name string) *zoneCut {
+	labels, _ := splitName(name)
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := 0; i < len(labels); i++ {
+		if cut, ok := r.cuts[joinLabels(labels[i:])]; ok && now.Before(cut.expires) {
+			return cut
+		}
+	}
+	if root, ok := r.cuts["."]; ok {
+		return root
+	}
+
+	root := &zoneCut{name: "."}
+	if r.Validate {
+		root.ds = r.Anchors
+		if len(root.ds) == 0 {
+			for _, anchor := range rootAnchors {
+				ds, _ := parseDS(".", anchor)
+				root.ds = append(root.ds, ds)
+			}
+		}
+	}
+	if r.cuts == nil {
+		r.cuts = make(map[string]*zoneCut)
+	}
+	r.cuts["."] = root
+	return root
+}
+
+// serversFor returns the zone's nameservers with the addresses we have
+// cached for them.
+func (r *Resolver) serversFor(cut *zoneCut) []*nameserver {
+	if cut.name == "." && len(cut.servers) == 0 {
+		roots := r.Roots
+		if len(roots) == 0 {
+			roots = rootHints
+		}
+		return []*nameserver{{addrs: roots, resolved: true}}
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var glued, glueless []*nameserver
+	for _, name := range cut.servers {
+		ns := &nameserver{name: name}
+		if cached, ok := r.addrs[name]; ok && now.Before(cached.expires) {
+			ns.addrs, ns.resolved = cached.addrs, true
+			glued = append(glued, ns)
+		} else {
+			glueless = append(glueless, ns)
+		}
+	}
+	return append(glued, glueless...)
+}
+
+func (r *Resolver) storeCut(cut *zoneCut) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cuts == nil {
+		r.cuts = make(map[string]*zoneCut)
+	}
+	r.cuts[cut.name] = cut
+	if len(r.cuts) > maxInfraEntries {
+		r.sweep()
+	}
+}
+
+func (r *Resolver) storeAddrs(name string, addrs []string, ttl time.Duration) {
+	if len(addrs) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.addrs == nil {
+		r.addrs = make(map[string]*cachedAddrs)
+	}
+	r.addrs[name] = &cachedAddrs{addrs: addrs, expires: time.Now().Add(ttl)}
+	if len(r.addrs) > maxInfraEntries {
+		r.sweep()
+	}
+}
+
+// sweep drops expired cache entries, and everything if that isn't enough.
+// The caller holds r.mu.
+func (r *Resolver) sweep() {
+	now := time.Now()
+	for name, cut := range r.cuts {
+		if name != "." && now.After(cut.expires) {
+			delete(r.cuts, name)
+		}
+	}
+	for name, cached := range r.addrs {
+		if now.After(cached.expires) {
+			delete(r.addrs, name)
+		}
+	}
+	for addr, stats := range r.stats {
+		if now.Sub(stats.LastUsed) > maxInfraTTL {
+			delete(r.stats, addr)
+		}
+	}
+	if len(r.cuts) > maxInfraEntries {
+		r.cuts = map[string]*zoneCut{".": r.cuts["."]}
+	}
+	if len(r.addrs) > maxInfraEntries {
+		r.addrs = make(map[string]*cachedAddrs)
+	}
+	if len(r.stats) > maxInfraEntries {
+		r.stats = make(map[string]*ServerStats)
+	}
+}
+
+// referral returns the zone a response delegates the name to, or "" if it
+// isn't a referral. Only delegations to zones below the one asked about and
+// above the name count, so a server can't send us sideways or back up.
+func referral(msg *DNSMessage, zone, name string) string {
+	if msg.Rcode() != RcodeSuccess || len(msg.Answers) > 0 {
+		return ""
+	}
+	for _, rr := range msg.Authorities {
+		owner := canonicalName(rr.NAME)
+		if rr.TYPE == TypeNS && owner != zone && isSubdomain(owner, zone) && isSubdomain(name, owner) {
+			return owner
+		}
+	}
+	return ""
+}
+
+// lame says why a response isn't one a server for the zone should give, or
+// returns "" if it is. Anything that's neither an answer nor a referral down
+// towards the name has to have AA set, since otherwise it's a server that
+// doesn't know about the zone, or is answering from a cache. An upward or
+// sideways referral, to the root say, is the usual way of saying so.
+func lame(msg *DNSMessage, zone, name string) string {
+	rcode := msg.Rcode()
+	switch {
+	case rcode != RcodeSuccess && rcode != RcodeNameError:
+		// error rcodes are handled by whoever asked
+		return ""
+	case msg.Header.AA == 1, len(msg.Answers) > 0, referral(msg, zone, name) != "":
+		return ""
+	}
+	for _, rr := range msg.Authorities {
+		if rr.TYPE == TypeNS {
+			return fmt.Sprintf("referral to %s, which isn't below %s", canonicalName(rr.NAME), zone)
+		}
+	}
+	return fmt.Sprintf("%s for %s isn't authoritative", rcodeString(rcode), name)
+}
+
+// answeringZone works out which zone an authoritative response came from,
+// from its SOA or signatures, in case it's below the zone we asked.
+func answeringZone(msg *DNSMessage, zone, name string) string {
+	best := zone
+	consider := func(owner string) {
+		owner = canonicalName(owner)
+		if isSubdomain(owner, best) && isSubdomain(name, owner) {
+			best = owner
+		}
+	}
+	for _, rr := range msg.Authorities {
+		if rr.TYPE == TypeSOA {
+			consider(rr.NAME)
+		}
+	}
+	for _, rr := range msg.Answers {
+		if rr.TYPE == TypeRRSIG && canonicalName(rr.NAME) == name && len(rr.RDATA) > 18 {
+			if signer, _, err := unpackName(rr.RDATA, 18); err == nil {
+				consider(signer)
+			}
+		}
+	}
+	return best
+}
+
+// inBailiwick drops the records a zone's servers have no authority over.
+func inBailiwick(records []DNSResourceRecord, zone string) []DNSResourceRecord {
+	var kept []DNSResourceRecord
+	for _, rr := range records {
+		if rr.TYPE != TypeOPT && isSubdomain(rr.NAME, zone) {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// matchRecords returns the records with the owner and type, where ANY
+// matches every type but RRSIG.
+func matchRecords(records []DNSResourceRecord, name string, qtype uint16) []DNSResourceRecord {
+	var matched []DNSResourceRecord
+	for _, rr := range records {
+		if canonicalName(rr.NAME) != name || rr.TYPE == TypeRRSIG {
+			continue
+		}
+		if rr.TYPE == qtype || qtype == TypeANY {
+			matched = append(matched, rr)
+		}
+	}
+	return matched
+}
+
+// withSignatures adds the RRSIGs covering an RRset to it.
+func withSignatures(rrset, records []DNSResourceRecord) []DNSResourceRecord {
+	out := append([]DNSResourceRecord{}, rrset...)
+	types := make(map[uint16]bool)
+	for _, rr := range rrset {
+		types[rr.TYPE] = true
+	}
+	owner := canonicalName(rrset[0].NAME)
+	for _, rr := range records {
+		if rr.TYPE == TypeRRSIG && canonicalName(rr.NAME) == owner && len(rr.RDATA) >= 2 &&
+			types[uint16(rr.RDATA[0])<<8|uint16(rr.RDATA[1])] {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// findDNAME returns a DNAME from the records that redirects the name, one
+// owned by any of its ancestors.
+func findDNAME(records []DNSResourceRecord, name string) *DNSResourceRecord {
+	for i := range records {
+		rr := &records[i]
+		owner := canonicalName(rr.NAME)
+		if rr.TYPE == TypeDNAME && owner != name && isSubdomain(name, owner) {
+			return rr
+		}
+	}
+	return nil
+}
+
+// synthesizeCNAME makes the CNAME a DNAME implies for a name below it
+// (RFC 6672 section 2.2).
+func synthesizeCNAME(dname *DNSResourceRecord, name string) (DNSResourceRecord, error) {
+	labels, err := splitName(name)
+	if err != nil {
+		return DNSResourceRecord{}, err
+	}
+	target, err := splitName(dname.Data)
+	if err != nil {
+		return DNSResourceRecord{}, err
+	}
+	prefix := labels[:len(labels)-labelCount(dname.NAME)]
+	newName := canonicalName(joinLabels(append(append([][]byte{}, prefix...), target...)))
+	rdata, err := packName(newName)
+	if err != nil {
+		return DNSResourceRecord{}, fmt.Errorf("DNAME makes %s too long: %w", name, err)
+	}
+	return DNSResourceRecord{NAME: name, TYPE: TypeCNAME, CLASS: ClassINET, TTL: dname.TTL, RDATA: rdata, Data: newName}, nil
+}
+
+// isSubdomain reports whether name is the same as or below parent.
+func isSubdomain(name, parent string) bool {
+	nameLabels, err := splitName(name)
+	if err != nil {
+		return false
+	}
+	parentLabels, err := splitName(parent)
+	if err != nil || len(parentLabels) > len(nameLabels) {
+		return false
+	}
+	offset := len(nameLabels) - len(parentLabels)
+	for i, label := range parentLabels {
+		if !bytes.EqualFold(label, nameLabels[offset+i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func labelCount(name string) int {
+	labels, _ := splitName(name)
+	return len(labels)
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRR builds a record from its presentation format, for the handful of
+// types the tests need.
+func testRR(t *testing.T, name string, rrtype uint16, data string) DNSResourceRecord {
+	t.Helper()
+	var rdata []byte
+	fields := strings.Fields(data)
+	switch rrtype {
+	case TypeA:
+		rdata = net.ParseIP(data).To4()
+	case TypeAAAA:
+		rdata = net.ParseIP(data).To16()
+	case TypeNS, TypeCNAME, TypeDNAME:
+		var err error
+		if rdata, err = packName(data); err != nil {
+			t.Fatal(err)
+		}
+	case TypeMX:
+		pref, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, err := packName(fields[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		rdata = append(binary.BigEndian.AppendUint16(nil, uint16(pref)), name...)
+	case TypeTXT:
+		// a string for each field
+		rdata = []byte{}
+		for _, field := range fields {
+			rdata = append(append(rdata, byte(len(field))), field...)
+		}
+	case TypeSOA:
+		for _, name := range fields[:2] {
+			buf, err := packName(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rdata = append(rdata, buf...)
+		}
+		for _, field := range fields[2:] {
+			n, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rdata = binary.BigEndian.AppendUint32(rdata, uint32(n))
+		}
+	default:
+		t.Fatalf("can't build %s records", typeString(rrtype))
+	}
+	if rdata == nil {
+		t.Fatalf("bad %s data %q", typeString(rrtype), data)
+	}
+	_, s, err := unpackRDATA(rdata, 0, len(rdata), rrtype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return DNSResourceRecord{NAME: name, TYPE: rrtype, CLASS: ClassINET, TTL: 3600, RDATA: rdata, Data: s}
+}
+
+// fakeZone answers for a zone from a list of records the way an
+// authoritative server would: referrals for names below its delegations,
+// the DNAME for names below one, NXDOMAIN for names it doesn't have, and
+// NODATA for types it doesn't.
+type fakeZone struct {
+	name    string
+	records []DNSResourceRecord
+}
+
+func (z *fakeZone) answer(query *DNSMessage) *DNSMessage {
+	resp := &DNSMessage{
+		Header:    DNSHeader{ID: query.Header.ID, QR: 1, RD: query.Header.RD},
+		Questions: query.Questions,
+	}
+	q := query.Questions[0]
+	name := canonicalName(q.QNAME)
+
+	for _, rr := range z.records {
+		owner := canonicalName(rr.NAME)
+		if rr.TYPE != TypeNS || owner == z.name || !isSubdomain(name, owner) || (name == owner && q.QTYPE == TypeDS) {
+			continue
+		}
+		for _, ns := range z.records {
+			if ns.TYPE == TypeNS && canonicalName(ns.NAME) == owner {
+				resp.Authorities = append(resp.Authorities, ns)
+				for _, glue := range z.records {
+					if (glue.TYPE == TypeA || glue.TYPE == TypeAAAA) && canonicalName(glue.NAME) == canonicalName(ns.Data) {
+						resp.Additionals = append(resp.Additionals, glue)
+					}
+				}
+			}
+		}
+		return resp
+	}
+
+	resp.Header.AA = 1
+	for _, rr := range z.records {
+		if rr.TYPE == TypeDNAME && canonicalName(rr.NAME) != name && isSubdomain(name, rr.NAME) {
+			resp.Answers = append(resp.Answers, rr)
+			return resp
+		}
+	}
+	exists := false
+	for _, rr := range z.records {
+		if isSubdomain(canonicalName(rr.NAME), name) {
+			exists = true
+		}
+		if canonicalName(rr.NAME) == name && (rr.TYPE == q.QTYPE || rr.TYPE == TypeCNAME) {
+			resp.Answers = append(resp.Answers, rr)
+		}
+	}
+	if len(resp.Answers) == 0 {
+		if !exists {
+			resp.Header.RCODE = RcodeNameError
+		}
+		for _, rr := range z.records {
+			if rr.TYPE == TypeSOA {
+				resp.Authorities = append(resp.Authorities, rr)
+			}
+		}
+	}
+	return resp
+}
+
+// serveFake answers udp and tcp queries on addr with whatever answer
+// returns, until the test ends, and returns the address it's listening on.
+func serveFake(t *testing.T, addr string, answer func(query *DNSMessage) *DNSMessage) string {
+	t.Helper()
+	addr = serveFakeUDP(t, addr, answer)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveFakeStream(t, l, answer)
+	return addr
+}
+
+// serveFakeStream answers queries on the connections the listener accepts,
+// with each prefixed by its length, until the test ends.
+func serveFakeStream(t *testing.T, l net.Listener, answer func(query *DNSMessage) *DNSMessage) {
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					length := make([]byte, 2)
+					if _, err := io.ReadFull(conn, length); err != nil {
+						return
+					}
+					buf := make([]byte, binary.BigEndian.Uint16(length))
+					if _, err := io.ReadFull(conn, buf); err != nil {
+						return
+					}
+					resp := fakeResponse(t, buf, answer)
+					if resp == nil {
+						return
+					}
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+				}
+			}()
+		}
+	}()
+}
+
+// serveFakeUDP is serveFake for just udp.
+func serveFakeUDP(t *testing.T, addr string, answer func(query *DNSMessage) *DNSMessage) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := fakeResponse(t, buf[:n], answer); resp != nil {
+				pc.WriteTo(resp, from)
+			}
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func fakeResponse(t *testing.T, buf []byte, answer func(query *DNSMessage) *DNSMessage) []byte {
+	query := &DNSMessage{}
+	if err := query.Unpack(buf); err != nil || len(query.Questions) != 1 {
+		return nil
+	}
+	resp := answer(query)
+	if resp == nil {
+		return nil
+	}
+	packed, err := resp.Pack()
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	return packed
+}
+
+// lameHierarchy serves a root, test. and lame.test. on loopback addresses,
+// where lame.test. has one good server and one that's lame, answering
+// without AA and referring back up to the root.
+func lameHierarchy(t *testing.T) *Resolver {
+	root := &fakeZone{name: ".", records: []DNSResourceRecord{
+		testRR(t, ".", TypeSOA, "a.root. hostmaster.root. 1 3600 600 86400 60"),
+		testRR(t, "test.", TypeNS, "ns.test."),
+		testRR(t, "ns.test.", TypeA, "127.0.0.2"),
+	}}
+	test := &fakeZone{name: "test.", records: []DNSResourceRecord{
+		testRR(t, "test.", TypeSOA, "ns.test. hostmaster.test. 1 3600 600 86400 60"),
+		testRR(t, "lame.test.", TypeNS, "ns1.lame.test."),
+		testRR(t, "lame.test.", TypeNS, "ns2.lame.test."),
+		testRR(t, "ns1.lame.test.", TypeA, "127.0.0.3"),
+		testRR(t, "ns2.lame.test.", TypeA, "127.0.0.4"),
+	}}
+	good := &fakeZone{name: "lame.test.", records: []DNSResourceRecord{
+		testRR(t, "lame.test.", TypeSOA, "ns2.lame.test. hostmaster.lame.test. 1 3600 600 86400 60"),
+		testRR(t, "www.lame.test.", TypeA, "192.0.2.1"),
+	}}
+	upward := testRR(t, ".", TypeNS, "a.root.")
+	lame := func(query *DNSMessage) *DNSMessage {
+		return &DNSMessage{
+			Header:      DNSHeader{ID: query.Header.ID, QR: 1},
+			Questions:   query.Questions,
+			Authorities: []DNSResourceRecord{upward},
+		}
+	}
+
+	_, port, _ := net.SplitHostPort(serveFake(t, "127.0.0.1:0", root.answer))
+	serveFake(t, net.JoinHostPort("127.0.0.2", port), test.answer)
+	serveFake(t, net.JoinHostPort("127.0.0.3", port), lame)
+	serveFake(t, net.JoinHostPort("127.0.0.4", port), good.answer)
+	return &Resolver{Roots: []string{"127.0.0.1"}, Port: port, Timeout: time.Second}
+}
+
+func TestResolveSkipsLameServers(t *testing.T) {
+	r := lameHierarchy(t)
+	for i := 0; i < 20; i++ {
+		// a fresh cache each time, so the lame server sometimes goes first
+		cold := &Resolver{Roots: r.Roots, Port: r.Port, Timeout: r.Timeout}
+		msg, err := cold.Resolve("www.lame.test.", TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Rcode() != RcodeSuccess || len(msg.Answers) != 1 || msg.Answers[0].Data != "192.0.2.1" {
+			t.Fatalf("resolution %d got:\n%s", i, msg)
+		}
+	}
+}
+
+func TestLame(t *testing.T) {
+	soa := testRR(t, "example.", TypeSOA, "ns.example. hostmaster.example. 1 3600 600 86400 60")
+	tests := []struct {
+		name string
+		msg  DNSMessage
+		lame bool
+	}{
+		{"authoritative nodata", DNSMessage{Header: DNSHeader{AA: 1}, Authorities: []DNSResourceRecord{soa}}, false},
+		{"authoritative nxdomain", DNSMessage{Header: DNSHeader{AA: 1, RCODE: RcodeNameError}, Authorities: []DNSResourceRecord{soa}}, false},
+		{"answer without aa", DNSMessage{Answers: []DNSResourceRecord{testRR(t, "www.example.", TypeA, "192.0.2.1")}}, false},
+		{"referral down", DNSMessage{Authorities: []DNSResourceRecord{testRR(t, "sub.example.", TypeNS, "ns.sub.example.")}}, false},
+		{"error rcode", DNSMessage{Header: DNSHeader{RCODE: RcodeServerFailure}}, false},
+		{"upward referral", DNSMessage{Authorities: []DNSResourceRecord{testRR(t, ".", TypeNS, "a.root.")}}, true},
+		{"sideways referral", DNSMessage{Authorities: []DNSResourceRecord{testRR(t, "other.", TypeNS, "ns.other.")}}, true},
+		{"nodata without aa", DNSMessage{Authorities: []DNSResourceRecord{soa}}, true},
+		{"nxdomain without aa", DNSMessage{Header: DNSHeader{RCODE: RcodeNameError}}, true},
+	}
+	for _, tt := range tests {
+		if got := lame(&tt.msg, "example.", "www.sub.example."); (got != "") != tt.lame {
+			t.Errorf("%s: lame is %q", tt.name, got)
+		}
+	}
+}
+
+// testHierarchy serves a root on 127.0.0.1 that delegates test. to a server
+// on 127.0.0.2 with the records, and returns a Resolver that starts there.
+func testHierarchy(t *testing.T, records ...DNSResourceRecord) *Resolver {
+	return serveHierarchy(t, testTLD(t, records...).answer)
+}
+
+// testTLD is the test. zone with the records added.
+func testTLD(t *testing.T, records ...DNSResourceRecord) *fakeZone {
+	return &fakeZone{name: "test.", records: append([]DNSResourceRecord{
+		testRR(t, "test.", TypeSOA, "ns.test. hostmaster.test. 1 3600 600 86400 60"),
+		testRR(t, "test.", TypeNS, "ns.test."),
+		testRR(t, "ns.test.", TypeA, "127.0.0.2"),
+	}, records...)}
+}
+
+// serveHierarchy is testHierarchy with test. answered by whatever answer
+// returns.
+func serveHierarchy(t *testing.T, answer func(query *DNSMessage) *DNSMessage) *Resolver {
+	root := &fakeZone{name: ".", records: []DNSResourceRecord{
+		testRR(t, ".", TypeSOA, "a.root. hostmaster.root. 1 3600 600 86400 60"),
+		testRR(t, "test.", TypeNS, "ns.test."),
+		testRR(t, "ns.test.", TypeA, "127.0.0.2"),
+	}}
+	_, port, _ := net.SplitHostPort(serveFake(t, "127.0.0.1:0", root.answer))
+	serveFake(t, net.JoinHostPort("127.0.0.2", port), answer)
+	return &Resolver{Roots: []string{"127.0.0.1"}, Port: port, Timeout: time.Second}
+}
+
+// brokenENTHierarchy has www.sub.test., but its test. server says the empty
+// non-terminal sub.test. doesn't exist.
+func brokenENTHierarchy(t *testing.T) *Resolver {
+	test := testTLD(t, testRR(t, "www.sub.test.", TypeA, "192.0.2.1"))
+	return serveHierarchy(t, func(query *DNSMessage) *DNSMessage {
+		resp := test.answer(query)
+		if canonicalName(query.Questions[0].QNAME) == "sub.test." {
+			resp.Header.RCODE = RcodeNameError
+		}
+		return resp
+	})
+}
+
+func TestResolve(t *testing.T) {
+	r := testHierarchy(t,
+		testRR(t, "www.test.", TypeA, "192.0.2.1"),
+		testRR(t, "alias.test.", TypeCNAME, "www.test."),
+		testRR(t, "old.test.", TypeDNAME, "test."),
+	)
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   uint16
+		answers []string
+	}{
+		{"www.test.", TypeA, RcodeSuccess, []string{"192.0.2.1"}},
+		{"www.test.", TypeAAAA, RcodeSuccess, nil},
+		{"missing.test.", TypeA, RcodeNameError, nil},
+		{"alias.test.", TypeA, RcodeSuccess, []string{"www.test.", "192.0.2.1"}},
+		{"www.old.test.", TypeA, RcodeSuccess, []string{"test.", "www.test.", "192.0.2.1"}},
+	}
+	for _, tt := range tests {
+		for _, minimise := range []bool{false, true} {
+			r.Minimise = minimise
+			msg, err := r.Resolve(tt.name, tt.qtype)
+			if err != nil {
+				t.Errorf("%s %s: %v", tt.name, typeString(tt.qtype), err)
+				continue
+			}
+			var answers []string
+			for _, rr := range msg.Answers {
+				answers = append(answers, rr.Data)
+			}
+			if msg.Rcode() != tt.rcode || strings.Join(answers, " ") != strings.Join(tt.answers, " ") {
+				t.Errorf("%s %s with minimise %v got:\n%s", tt.name, typeString(tt.qtype), minimise, msg)
+			}
+		}
+	}
+}
+
+func TestResolveMinimisationFallback(t *testing.T) {
+	r := brokenENTHierarchy(t)
+	r.Minimise = true
+	var notes []*ResolveStep
+	r.Trace = func(step *ResolveStep) {
+		if step.Note != "" {
+			notes = append(notes, step)
+		}
+	}
+	msg, err := r.Resolve("www.sub.test.", TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Rcode() != RcodeSuccess || len(msg.Answers) != 1 || msg.Answers[0].Data != "192.0.2.1" {
+		t.Errorf("got:\n%s", msg)
+	}
+	if len(notes) != 1 || notes[0].Name != "sub.test." || notes[0].Msg.Rcode() != RcodeNameError {
+		t.Errorf("got fallback steps %v", notes)
+	}
+}
+
+func TestReferral(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  DNSMessage
+		want string
+	}{
+		{"down", DNSMessage{Authorities: []DNSResourceRecord{testRR(t, "sub.example.", TypeNS, "ns.sub.example.")}}, "sub.example."},
+		{"to the name", DNSMessage{Authorities: []DNSResourceRecord{testRR(t, "www.sub.example.", TypeNS, "ns.example.")}}, "www.sub.example."},
+		{"to the zone itself", DNSMessage{Authorities: []DNSResourceRecord{testRR(t, "example.", TypeNS, "ns.example.")}}, ""},
+		{"upward", DNSMessage{Authorities: []DNSResourceRecord{testRR(t, ".", TypeNS, "a.root.")}}, ""},
+		{"sideways", DNSMessage{Authorities: []DNSResourceRecord{testRR(t, "other.example.", TypeNS, "ns.other.example.")}}, ""},
+		{"with an answer", DNSMessage{
+			Answers:     []DNSResourceRecord{testRR(t, "www.sub.example.", TypeA, "192.0.2.1")},
+			Authorities: []DNSResourceRecord{testRR(t, "sub.example.", TypeNS, "ns.sub.example.")},
+		}, ""},
+		{"nxdomain", DNSMessage{
+			Header:      DNSHeader{RCODE: RcodeNameError},
+			Authorities: []DNSResourceRecord{testRR(t, "sub.example.", TypeNS, "ns.sub.example.")},
+		}, ""},
+	}
+	for _, tt := range tests {
+		if got := referral(&tt.msg, "example.", "www.sub.example."); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInBailiwick(t *testing.T) {
+	records := []DNSResourceRecord{
+		testRR(t, "example.", TypeNS, "ns.example."),
+		testRR(t, "ns.example.", TypeA, "192.0.2.1"),
+		testRR(t, "WWW.Example.", TypeA, "192.0.2.2"),
+		testRR(t, "ns.other.", TypeA, "192.0.2.3"),
+		testRR(t, "badexample.", TypeA, "192.0.2.4"),
+		testRR(t, "com.", TypeNS, "a.gtld-servers.net."),
+		{NAME: ".", TYPE: TypeOPT, CLASS: DefaultUDPSize},
+	}
+	var got []string
+	for _, rr := range inBailiwick(records, "example.") {
+		got = append(got, rr.NAME)
+	}
+	if want := "example. ns.example. WWW.Example."; strings.Join(got, " ") != want {
+		t.Errorf("got %q, want %q", strings.Join(got, " "), want)
+	}
+}
+
+func TestSynthesizeCNAME(t *testing.T) {
+	tests := []struct {
+		dname string
+		name  string
+		want  string
+		err   bool
+	}{
+		{"example.", "www.example.", "www.example.net.", false},
+		{"example.", "a.b.example.", "a.b.example.net.", false},
+		{"Example.", "WWW.example.", "www.example.net.", false},
+		{"example.", strings.Repeat("a.", 122) + "example.", "", true},
+	}
+	for _, tt := range tests {
+		dname := testRR(t, tt.dname, TypeDNAME, "example.net.")
+		dname.TTL = 300
+		cname, err := synthesizeCNAME(&dname, tt.name)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: got %s, want an error", tt.name, cname.Data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if cname.NAME != tt.name || cname.TYPE != TypeCNAME || cname.TTL != 300 || cname.Data != tt.want {
+			t.Errorf("%s: got %s", tt.name, cname.String())
+		}
+		if target, _, err := unpackName(cname.RDATA, 0); err != nil || canonicalName(target) != tt.want {
+			t.Errorf("%s: RDATA is % x", tt.name, cname.RDATA)
+		}
+	}
+}
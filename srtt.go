@@ -0,0 +1,176 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Nameserver addresses are tried in order of their smoothed round trip time,
+// so a zone's fastest server gets most of the queries. Every so often another
+// one goes first instead, so a server that has got faster gets noticed.
+const (
+	// each response moves the smoothed rtt this fraction of the way to the
+	// new sample (RFC 6298 uses the same weight for TCP)
+	srttWeight = 8
+
+	// one query in this many goes to a server other than the best
+	exploreRate = 20
+
+	// an address that fails is skipped for minBackoff, doubling with each
+	// failure in a row up to maxBackoff
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// ServerStats is what a Resolver knows about one nameserver address.
+type ServerStats struct {
+	Addr     string
+	SRTT     time.Duration // zero until it's answered
+	Queries  uint64
+	Failures uint64 // timeouts, network errors, and responses we couldn't use
+	Backoff  time.Time
+	LastUsed time.Time
+
+	failing int // failures since the last response
+}
+
+// serverAddr is one address of one of a zone's nameservers.
+type serverAddr struct {
+	ns   *nameserver
+	addr string
+	srtt time.Duration
+}
+
+// rank orders the addresses of the servers best first: untried ones in a
+// random order, then by smoothed rtt, and ones that are backing off last.
+// The families are interleaved, so that if the best address's family is
+// broken the next one to try is in the other.
+func (r *Resolver) rank(servers []*nameserver) []serverAddr {
+	var targets []serverAddr
+	seen := make(map[string]bool)
+	for _, ns := range servers {
+		for _, addr := range ns.addrs {
+			if !seen[addr] {
+				seen[addr] = true
+				targets = append(targets, serverAddr{ns: ns, addr: addr})
+			}
+		}
+	}
+	rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+
+	now := time.Now()
+	var ready, backingOff []serverAddr
+	r.mu.Lock()
+	for _, target := range targets {
+		s, ok := r.stats[target.addr]
+		if ok {
+			target.srtt = s.SRTT
+		}
+		if ok && now.Before(s.Backoff) {
+			backingOff = append(backingOff, target)
+		} else {
+			ready = append(ready, target)
+		}
+	}
+	r.mu.Unlock()
+
+	sort.SliceStable(ready, func(i, j int) bool { return ready[i].srtt < ready[j].srtt })
+	if len(ready) > 1 && rand.Intn(exploreRate) == 0 {
+		i := 1 + rand.Intn(len(ready)-1)
+		ready[0], ready[i] = ready[i], ready[0]
+	}
+
+	byAddr := make(map[string]serverAddr, len(ready))
+	addrs := make([]string, len(ready))
+	for i, target := range ready {
+		byAddr[target.addr] = target
+		addrs[i] = target.addr
+	}
+	ranked := make([]serverAddr, 0, len(targets))
+	for _, addr := range interleave(addrs) {
+		ranked = append(ranked, byAddr[addr])
+	}
+	return append(ranked, backingOff...)
+}
+
+// observe updates an address's stats with the outcome of a query to it.
+func (r *Resolver) observe(step *ResolveStep) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stats == nil {
+		r.stats = make(map[string]*ServerStats)
+	}
+	s, ok := r.stats[step.Addr]
+	if !ok {
+		if len(r.stats) >= maxInfraEntries {
+			r.sweep()
+		}
+		s = &ServerStats{Addr: step.Addr}
+		r.stats[step.Addr] = s
+	}
+	s.Queries++
+	s.LastUsed = now
+
+	if step.Err != nil && step.Msg == nil {
+		families.failed(step.Addr)
+
+		// a timeout counts as an rtt of the whole timeout, so a server that
+		// drops some of its queries ends up behind one that's just slow
+		if isTimeout(step.Err) {
+			s.SRTT = smooth(s.SRTT, step.Latency)
+		}
+		s.Failures++
+		s.failing++
+		backoff := maxBackoff
+		if s.failing <= 16 && minBackoff<<(s.failing-1) < maxBackoff {
+			backoff = minBackoff << (s.failing - 1)
+		}
+		s.Backoff = now.Add(backoff)
+		return
+	}
+
+	// an error rcode or a lame answer is the server's answer for this zone,
+	// and it may well be fine for the others it serves, so it doesn't back
+	// off. It's no more use than no answer at all, though, so it counts as
+	// an rtt of the whole timeout, and servers that give usable answers go
+	// first.
+	families.worked(step.Addr)
+	sample := step.Latency
+	rcode := step.Msg.Rcode()
+	if step.Err != nil || (rcode != RcodeSuccess && rcode != RcodeNameError) {
+		s.Failures++
+		if sample < r.Timeout {
+			sample = r.Timeout
+		}
+	}
+	s.SRTT = smooth(s.SRTT, sample)
+	s.failing = 0
+	s.Backoff = time.Time{}
+}
+
+func smooth(srtt, sample time.Duration) time.Duration {
+	if srtt == 0 {
+		return sample
+	}
+	return srtt + (sample-srtt)/srttWeight
+}
+
+// ServerStats returns what the Resolver knows about each nameserver address
+// it has queried, fastest first.
+func (r *Resolver) ServerStats() []ServerStats {
+	r.mu.Lock()
+	stats := make([]ServerStats, 0, len(r.stats))
+	for _, s := range r.stats {
+		stats = append(stats, *s)
+	}
+	r.mu.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].SRTT != stats[j].SRTT {
+			return stats[i].SRTT < stats[j].SRTT
+		}
+		return stats[i].Addr < stats[j].Addr
+	})
+	return stats
+}
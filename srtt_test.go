@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestObserve(t *testing.T) {
+	resetFamilies(t)
+	ok := &DNSMessage{Header: DNSHeader{QR: 1, AA: 1}}
+	refused := &DNSMessage{Header: DNSHeader{QR: 1, RCODE: RcodeRefused}}
+	tests := []struct {
+		name     string
+		step     ResolveStep
+		srtt     time.Duration
+		failures uint64
+		backoff  bool
+	}{
+		{"answer", ResolveStep{Msg: ok, Latency: 10 * time.Millisecond}, 10 * time.Millisecond, 0, false},
+		{"error rcode", ResolveStep{Msg: refused, Latency: 10 * time.Millisecond}, time.Second, 1, false},
+		{"lame", ResolveStep{Msg: ok, Err: errLame, Latency: 10 * time.Millisecond}, time.Second, 1, false},
+		{"timeout", ResolveStep{Err: os.ErrDeadlineExceeded, Latency: time.Second}, time.Second, 1, true},
+		{"network error", ResolveStep{Err: errors.New("connection refused"), Latency: time.Millisecond}, 0, 1, true},
+	}
+	for _, tt := range tests {
+		r := &Resolver{Timeout: time.Second}
+		tt.step.Addr = "192.0.2.1"
+		r.observe(&tt.step)
+		s := r.ServerStats()[0]
+		if s.SRTT != tt.srtt || s.Failures != tt.failures || s.Backoff.IsZero() == tt.backoff {
+			t.Errorf("%s: got srtt %s, %d failures, backoff %s", tt.name, s.SRTT, s.Failures, s.Backoff)
+		}
+	}
+}
+
+func TestRankPrefersUsableAnswers(t *testing.T) {
+	resetFamilies(t)
+	r := &Resolver{Timeout: time.Second}
+	ok := &DNSMessage{Header: DNSHeader{QR: 1, AA: 1}}
+	for i := 0; i < 5; i++ {
+		r.observe(&ResolveStep{Addr: "192.0.2.1", Msg: ok, Err: errLame, Latency: time.Millisecond})
+		r.observe(&ResolveStep{Addr: "192.0.2.2", Msg: ok, Latency: 50 * time.Millisecond})
+		r.observe(&ResolveStep{Addr: "192.0.2.3", Err: errors.New("connection refused")})
+	}
+	servers := []*nameserver{{addrs: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}}}
+	first := 0
+	for i := 0; i < 200; i++ {
+		ranked := r.rank(servers)
+		if ranked[len(ranked)-1].addr != "192.0.2.3" {
+			t.Fatalf("backed off address isn't last: %v", ranked)
+		}
+		if ranked[0].addr == "192.0.2.2" {
+			first++
+		}
+	}
+	// it only loses out when another gets explored
+	if first < 150 {
+		t.Errorf("the server with usable answers went first %d times in 200", first)
+	}
+}
+
+func TestResolveAvoidsLameServers(t *testing.T) {
+	resetFamilies(t)
+	r := lameHierarchy(t)
+	for i := 0; i < 100; i++ {
+		msg, err := r.Resolve("www.lame.test.", TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msg.Answers) != 1 {
+			t.Fatalf("resolution %d got:\n%s", i, msg)
+		}
+	}
+	for _, s := range r.ServerStats() {
+		if s.Addr == "127.0.0.3" && s.Queries > 25 {
+			t.Errorf("lame server got %d of 100 queries", s.Queries)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+func traceMain(args []string) error {
+	flags := flag.NewFlagSet("trace", flag.ExitOnError)
+	qmin := flags.Bool("qmin", true, "send each nameserver only as much of the name as it needs (RFC 9156)")
+	roots := flags.String("roots", "", "comma separated root server addresses to start from, instead of the real roots")
+	port := flags.String("port", "53", "port to query nameservers on")
+	timeout := flags.Duration("timeout", 3*time.Second, "how long to wait for each response")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dunce trace name [type] [flags]")
+		flags.PrintDefaults()
+	}
+	positional := parseInterspersed(flags, args)
+
+	if len(positional) < 1 || len(positional) > 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	name := positional[0]
+	qtype := TypeA
+	if len(positional) == 2 {
+		var err error
+		if qtype, err = parseType(positional[1]); err != nil {
+			return err
+		}
+	}
+
+	// a server that falls over when it gets a minimised name is worth
+	// calling out, since that's the main thing to check with -qmin
+	var fallback *ResolveStep
+	resolver := &Resolver{Port: *port, Timeout: *timeout, Minimise: *qmin}
+	if *roots != "" {
+		resolver.Roots = strings.Split(*roots, ",")
+	}
+	resolver.Trace = func(step *ResolveStep) {
+		printTraceStep(step)
+		if step.Note != "" && step.Depth == 0 {
+			fallback = step
+		}
+	}
+
+	msg, err := resolver.Resolve(name, qtype)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Printf(";; %s %s: %s\n", canonicalName(name), typeString(qtype), rcodeString(msg.Rcode()))
+	for i := range msg.Answers {
+		fmt.Println(msg.Answers[i].String())
+	}
+	// it's only the server's fault if the full name got a different answer
+	if fallback != nil && fallback.Msg.Rcode() != msg.Rcode() {
+		fmt.Println()
+		fmt.Printf(";; %s broke QNAME minimisation: it answered %s for %s\n",
+			serverLabel(fallback), rcodeString(fallback.Msg.Rcode()), fallback.Name)
+	}
+	return nil
+}
+
+func printTraceStep(step *ResolveStep) {
+	indent := strings.Repeat("    ", step.Depth)
+	if step.Addr == "" {
+		// not a query, just something that went wrong finding a server
+		fmt.Printf("%s%-16s %s: %v\n", indent, step.Zone, step.Server, step.Err)
+		return
+	}
+
+	query := fmt.Sprintf("%s %s", step.Name, typeString(step.Type))
+	if step.Err != nil {
+		fmt.Printf("%s%-16s %s  %s  error: %v\n", indent, step.Zone, serverLabel(step), query, step.Err)
+		return
+	}
+
+	var result string
+	switch {
+	case step.Referral != "":
+		ns := recordsData(step.Msg.Authorities, step.Referral, TypeNS)
+		result = fmt.Sprintf("referral to %s (%s)", step.Referral, strings.Join(ns, " "))
+	case len(step.Msg.Answers) > 0:
+		result = fmt.Sprintf("%s, %d answers", rcodeString(step.Msg.Rcode()), len(step.Msg.Answers))
+	default:
+		result = rcodeString(step.Msg.Rcode())
+	}
+	for _, e := range step.Msg.ExtendedErrors() {
+		result += fmt.Sprintf(" (EDE %s)", e)
+	}
+	fmt.Printf("%s%-16s %s  %s  %s  %.1fms\n", indent, step.Zone, serverLabel(step), query, result,
+		float64(step.Latency.Microseconds())/1000)
+	if step.Note != "" {
+		fmt.Printf("%s    ! %s\n", indent, step.Note)
+	}
+}
+
+func serverLabel(step *ResolveStep) string {
+	if step.Server == "" {
+		return "@" + step.Addr
+	}
+	return fmt.Sprintf("@%s (%s)", step.Server, step.Addr)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTraceReportsBrokenMinimisation(t *testing.T) {
+	tests := []struct {
+		name   string
+		r      *Resolver
+		report string // empty for none
+	}{
+		{"broken", brokenENTHierarchy(t), "broke QNAME minimisation: it answered NXDOMAIN for sub.test."},
+		{"working", testHierarchy(t, testRR(t, "www.sub.test.", TypeA, "192.0.2.1")), ""},
+	}
+	for _, tt := range tests {
+		var err error
+		out := captureStdout(t, func() {
+			err = traceMain([]string{"www.sub.test.", "-roots", tt.r.Roots[0], "-port", tt.r.Port})
+		})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !strings.Contains(out, "192.0.2.1") {
+			t.Errorf("%s: no answer in:\n%s", tt.name, out)
+		}
+		if got := strings.Contains(out, "broke QNAME minimisation"); got != (tt.report != "") || !strings.Contains(out, tt.report) {
+			t.Errorf("%s: want report %q in:\n%s", tt.name, tt.report, out)
+		}
+	}
+}
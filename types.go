@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	TypeA      uint16 = 1
+	TypeNS     uint16 = 2
+	TypeCNAME  uint16 = 5
+	TypeSOA    uint16 = 6
+	TypePTR    uint16 = 12
+	TypeHINFO  uint16 = 13
+	TypeMX     uint16 = 15
+	TypeTXT    uint16 = 16
+	TypeAAAA   uint16 = 28
+	TypeSRV    uint16 = 33
+	TypeDNAME  uint16 = 39
+	TypeOPT    uint16 = 41
+	TypeDS     uint16 = 43
+	TypeRRSIG  uint16 = 46
+	TypeNSEC   uint16 = 47
+	TypeDNSKEY uint16 = 48
+	TypeNSEC3  uint16 = 50
+	TypeSVCB   uint16 = 64
+	TypeHTTPS  uint16 = 65
+	TypeIXFR   uint16 = 251
+	TypeAXFR   uint16 = 252
+	TypeANY    uint16 = 255
+	TypeCAA    uint16 = 257
+)
+
+const ClassINET uint16 = 1
+
+const (
+	RcodeSuccess        uint16 = 0
+	RcodeFormatError    uint16 = 1
+	RcodeServerFailure  uint16 = 2
+	RcodeNameError      uint16 = 3
+	RcodeNotImplemented uint16 = 4
+	RcodeRefused        uint16 = 5
+)
+
+var typeNames = map[uint16]string{
+	TypeA:      "A",
+	TypeNS:     "NS",
+	TypeCNAME:  "CNAME",
+	TypeSOA:    "SOA",
+	TypePTR:    "PTR",
+	TypeHINFO:  "HINFO",
+	TypeMX:     "MX",
+	TypeTXT:    "TXT",
+	TypeAAAA:   "AAAA",
+	TypeSRV:    "SRV",
+	TypeDNAME:  "DNAME",
+	TypeOPT:    "OPT",
+	TypeDS:     "DS",
+	TypeRRSIG:  "RRSIG",
+	TypeNSEC:   "NSEC",
+	TypeDNSKEY: "DNSKEY",
+	TypeNSEC3:  "NSEC3",
+	TypeSVCB:   "SVCB",
+	TypeHTTPS:  "HTTPS",
+	TypeIXFR:   "IXFR",
+	TypeAXFR:   "AXFR",
+	TypeANY:    "ANY",
+	TypeCAA:    "CAA",
+}
+
+var rcodeNames = map[uint16]string{
+	0:  "NOERROR",
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	6:  "YXDOMAIN",
+	7:  "YXRRSET",
+	8:  "NXRRSET",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+	16: "BADVERS",
+}
+
+var opcodeNames = map[uint16]string{
+	0: "QUERY",
+	1: "IQUERY",
+	2: "STATUS",
+	4: "NOTIFY",
+	5: "UPDATE",
+}
+
+// typeString returns the mnemonic for a TYPE, or the RFC 3597 TYPEnnn form
+// for types we don't know by name.
+func typeString(t uint16) string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+func parseType(s string) (uint16, error) {
+	s = strings.ToUpper(s)
+	for t, name := range typeNames {
+		if name == s {
+			return t, nil
+		}
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		t, err := strconv.ParseUint(s[4:], 10, 16)
+		if err == nil {
+			return uint16(t), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown record type '%s'", s)
+}
+
+func opcodeString(opcode uint16) string {
+	if name, ok := opcodeNames[opcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("OPCODE%d", opcode)
+}
+
+func rcodeString(rcode uint16) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+func parseRcode(s string) (uint16, error) {
+	s = strings.ToUpper(s)
+	for rcode, name := range rcodeNames {
+		if name == s {
+			return rcode, nil
+		}
+	}
+	if strings.HasPrefix(s, "RCODE") {
+		rcode, err := strconv.ParseUint(s[5:], 10, 12)
+		if err == nil {
+			return uint16(rcode), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown rcode '%s'", s)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	clearLine   = "\r\033[K"
+)
+
+type watchState struct {
+	rcode   uint16
+	serial  string
+	ede     string
+	nsid    string
+	records map[string]bool
+}
+
+func watchMain(args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	interval := flags.Duration("interval", 5*time.Second, "time between queries")
+	until := flags.String("until", "", "exit once an answer has this value")
+	transport := flags.String("transport", TransportUDP, "transport for a server without a scheme: udp, tcp, tls or https")
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to wait for each response")
+	nsid := flags.Bool("nsid", false, "ask the server to identify itself with NSID (RFC 5001), to see which instance answers")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dunce watch name type [@server] [flags]")
+		flags.PrintDefaults()
+	}
+	positional := parseInterspersed(flags, args)
+
+	if len(positional) < 2 || len(positional) > 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	name := positional[0]
+	qtype, err := parseType(positional[1])
+	if err != nil {
+		return err
+	}
+	server := "8.8.8.8"
+	if len(positional) == 3 {
+		server = positional[2]
+	}
+	client, err := newClientForSpec(server, *transport, *timeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	client.Options.EDNS = true
+	client.Options.EDNSFallback = true
+	client.Options.NSID = *nsid
+
+	// countdowns and colors only make sense on a terminal
+	tty := false
+	if info, err := os.Stdout.Stat(); err == nil {
+		tty = info.Mode()&os.ModeCharDevice != 0
+	}
+	color := func(c, s string) string {
+		if !tty {
+			return s
+		}
+		return c + s + colorReset
+	}
+
+	var last *watchState
+	for {
+		start := time.Now()
+		msg, err := client.Query(name, qtype)
+		latency := time.Since(start)
+		stamp := start.Format("15:04:05")
+		if tty {
+			fmt.Print(clearLine)
+		}
+		if err != nil {
+			fmt.Printf("%s %s\n", stamp, color(colorRed, err.Error()))
+		} else {
+			state := newWatchState(msg)
+			printWatchChanges(stamp, latency, msg, last, state, color)
+			last = state
+			if *until != "" && state.has(*until) {
+				fmt.Printf("%s %s\n", stamp, color(colorGreen, "found "+*until))
+				return nil
+			}
+		}
+
+		next := start.Add(*interval)
+		if !tty || msg == nil {
+			time.Sleep(time.Until(next))
+			continue
+		}
+		ttl := minTTL(msg.Answers)
+		for now := time.Now(); now.Before(next); now = time.Now() {
+			status := fmt.Sprintf("  next query in %ds", int(next.Sub(now).Seconds()+0.5))
+			if ttl >= 0 {
+				remaining := time.Duration(ttl)*time.Second - now.Sub(start)
+				if remaining < 0 {
+					remaining = 0
+				}
+				status = fmt.Sprintf("  ttl %ds,%s", int(remaining.Seconds()), status)
+			}
+			fmt.Print(clearLine + status)
+			if wait := time.Until(next); wait < time.Second {
+				time.Sleep(wait)
+			} else {
+				time.Sleep(time.Second)
+			}
+		}
+	}
+}
+
+func newWatchState(msg *DNSMessage) *watchState {
+	state := &watchState{rcode: msg.Rcode(), records: make(map[string]bool)}
+	var ede []string
+	for _, e := range msg.ExtendedErrors() {
+		ede = append(ede, e.String())
+	}
+	state.ede = strings.Join(ede, "; ")
+	if nsid, ok := msg.NSID(); ok {
+		state.nsid = nsidString(nsid)
+	}
+	for _, key := range uniqueRecords(msg.Answers) {
+		state.records[key] = true
+	}
+	// negative answers carry the zone's SOA in the authority section
+	for _, section := range [][]DNSResourceRecord{msg.Answers, msg.Authorities} {
+		for _, rr := range section {
+			if rr.TYPE == TypeSOA {
+				state.serial = soaSerialField(rr.Data)
+			}
+		}
+	}
+	return state
+}
+
+// has reports whether any answer has the value, ignoring case and the
+// trailing dot on names.
+func (s *watchState) has(value string) bool {
+	value = canonicalName(value)
+	for key := range s.records {
+		fields := strings.SplitN(key, "\t", 4)
+		if canonicalName(fields[3]) == value {
+			return true
+		}
+	}
+	return false
+}
+
+func printWatchChanges(stamp string, latency time.Duration, msg *DNSMessage, last, state *watchState, color func(c, s string) string) {
+	if last == nil {
+		fmt.Printf("%s %s  %s  (%v)\n", stamp, rcodeString(state.rcode), msg.Header.Flags(), latency.Round(time.Microsecond))
+		for i := range msg.Answers {
+			fmt.Printf("  %s\n", msg.Answers[i].String())
+		}
+		if state.serial != "" {
+			fmt.Printf("  serial %s\n", state.serial)
+		}
+		if state.nsid != "" {
+			fmt.Printf("  NSID: %s\n", state.nsid)
+		}
+		if state.ede != "" {
+			fmt.Printf("  EDE: %s\n", state.ede)
+		}
+		return
+	}
+
+	var changes []string
+	if state.rcode != last.rcode {
+		changes = append(changes, color(colorYellow, fmt.Sprintf("rcode %s -> %s", rcodeString(last.rcode), rcodeString(state.rcode))))
+	}
+	if state.serial != last.serial {
+		changes = append(changes, color(colorYellow, fmt.Sprintf("serial %s -> %s", orNone(last.serial), orNone(state.serial))))
+	}
+	if state.nsid != last.nsid {
+		changes = append(changes, color(colorYellow, fmt.Sprintf("NSID %s -> %s", orNone(last.nsid), orNone(state.nsid))))
+	}
+	if state.ede != last.ede {
+		changes = append(changes, color(colorYellow, fmt.Sprintf("EDE %s -> %s", orNone(last.ede), orNone(state.ede))))
+	}
+	var removed, added, diff []string
+	for key := range last.records {
+		if !state.records[key] {
+			removed = append(removed, key)
+		}
+	}
+	for key := range state.records {
+		if !last.records[key] {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(added)
+	for _, key := range removed {
+		diff = append(diff, color(colorRed, "- "+key))
+	}
+	for _, key := range added {
+		diff = append(diff, color(colorGreen, "+ "+key))
+	}
+	if len(diff) > 0 {
+		changes = append(changes, color(colorYellow, "answers changed"))
+	}
+
+	if len(changes) == 0 {
+		ttl := ""
+		if t := minTTL(msg.Answers); t >= 0 {
+			ttl = fmt.Sprintf(", ttl %d", t)
+		}
+		fmt.Printf("%s unchanged%s  (%v)\n", stamp, ttl, latency.Round(time.Microsecond))
+		return
+	}
+	fmt.Printf("%s %s  (%v)\n", stamp, strings.Join(changes, ", "), latency.Round(time.Microsecond))
+	for _, line := range diff {
+		fmt.Printf("  %s\n", line)
+	}
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// minTTL returns the lowest TTL among the records, or -1 if there are none.
+func minTTL(records []DNSResourceRecord) int64 {
+	ttl := int64(-1)
+	for _, rr := range records {
+		if ttl < 0 || int64(rr.TTL) < ttl {
+			ttl = int64(rr.TTL)
+		}
+	}
+	return ttl
+}
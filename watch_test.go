@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrintWatchChanges(t *testing.T) {
+	a1 := testRR(t, "www.example.", TypeA, "192.0.2.1")
+	a2 := testRR(t, "www.example.", TypeA, "192.0.2.2")
+	lowTTL := a1
+	lowTTL.TTL = 3000
+	soa5 := testRR(t, "example.", TypeSOA, "ns.example. hostmaster.example. 5 3600 600 86400 60")
+	soa6 := testRR(t, "example.", TypeSOA, "ns.example. hostmaster.example. 6 3600 600 86400 60")
+	var rdata []byte
+	rdata = appendEDNSOption(rdata, OptionNSID, []byte("ns1"))
+	rdata = appendEDE(rdata, ExtendedError{InfoCode: EDENoReachableAuthority, ExtraText: "all servers failed"})
+	opt := DNSResourceRecord{NAME: ".", TYPE: TypeOPT, CLASS: DefaultUDPSize, RDATA: rdata}
+	msg := func(rcode uint16, answers, authorities, additionals []DNSResourceRecord) *DNSMessage {
+		return &DNSMessage{Header: DNSHeader{QR: 1, RD: 1, RA: 1, RCODE: rcode}, Answers: answers, Authorities: authorities, Additionals: additionals}
+	}
+
+	// each message is compared with the one before
+	tests := []struct {
+		name string
+		msg  *DNSMessage
+		want string
+	}{
+		{"first", msg(RcodeSuccess, []DNSResourceRecord{a1}, nil, nil),
+			"12:00:00 NOERROR  qr rd ra  (1ms)\n  www.example.\t3600\tIN\tA\t192.0.2.1\n"},
+		{"ttl only", msg(RcodeSuccess, []DNSResourceRecord{lowTTL}, nil, nil),
+			"12:00:00 unchanged, ttl 3000  (1ms)\n"},
+		{"answers", msg(RcodeSuccess, []DNSResourceRecord{a2, a1}, nil, nil),
+			"12:00:00 answers changed  (1ms)\n  + www.example.\tIN\tA\t192.0.2.2\n"},
+		{"same answers in another order", msg(RcodeSuccess, []DNSResourceRecord{a1, a2}, nil, nil),
+			"12:00:00 unchanged, ttl 3600  (1ms)\n"},
+		{"nxdomain", msg(RcodeNameError, nil, []DNSResourceRecord{soa5}, nil),
+			"12:00:00 rcode NOERROR -> NXDOMAIN, serial none -> 5, answers changed  (1ms)\n" +
+				"  - www.example.\tIN\tA\t192.0.2.1\n  - www.example.\tIN\tA\t192.0.2.2\n"},
+		{"no answers unchanged", msg(RcodeNameError, nil, []DNSResourceRecord{soa5}, nil),
+			"12:00:00 unchanged  (1ms)\n"},
+		{"serial, nsid and ede", msg(RcodeNameError, nil, []DNSResourceRecord{soa6}, []DNSResourceRecord{opt}),
+			"12:00:00 serial 5 -> 6, NSID none -> 6e 73 31 (\"ns1\"), EDE none -> 22 (No Reachable Authority): all servers failed  (1ms)\n"},
+		{"nsid and ede gone", msg(RcodeNameError, nil, []DNSResourceRecord{soa6}, nil),
+			"12:00:00 NSID 6e 73 31 (\"ns1\") -> none, EDE 22 (No Reachable Authority): all servers failed -> none  (1ms)\n"},
+	}
+	plain := func(c, s string) string { return s }
+	var last *watchState
+	for _, tt := range tests {
+		state := newWatchState(tt.msg)
+		out := captureStdout(t, func() {
+			printWatchChanges("12:00:00", time.Millisecond, tt.msg, last, state, plain)
+		})
+		if out != tt.want {
+			t.Errorf("%s: got:\n%s\nwant:\n%s", tt.name, out, tt.want)
+		}
+		last = state
+	}
+}
+
+func TestWatchStateHas(t *testing.T) {
+	state := newWatchState(&DNSMessage{Answers: []DNSResourceRecord{
+		testRR(t, "www.example.", TypeCNAME, "Web.Example."),
+		testRR(t, "web.example.", TypeA, "192.0.2.1"),
+		testRR(t, "web.example.", TypeAAAA, "2001:db8::1"),
+	}})
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"web.example.", true},
+		{"WEB.EXAMPLE", true},
+		{"2001:DB8::1", true},
+		// owners aren't values
+		{"www.example.", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := state.has(tt.value); got != tt.want {
+			t.Errorf("%q: got %v", tt.value, got)
+		}
+	}
+}
+
+func TestWatchUntil(t *testing.T) {
+	server := serveFake(t, "127.0.0.1:0", testZone(t).answer)
+	var err error
+	out := captureStdout(t, func() {
+		err = watchMain([]string{"www.example.", "A", "@" + server, "-until", "192.0.2.1", "-interval", "10ms"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[2], " found 192.0.2.1") {
+		t.Errorf("got:\n%s", out)
+	}
+}